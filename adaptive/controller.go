@@ -0,0 +1,191 @@
+package adaptive
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Controller decides whether caching is worthwhile by comparing the rolling time spent keeping the cache
+// up-to-date (e.g. reading the stream) with the rolling time saved by retrieving items from the cache. When
+// caching costs more than it saves, it's disabled, and periodically re-enabled to check again.
+//
+// The decision is made for the cache as a whole, using the total time saved by all data sources, since the
+// stream is read once for all of them. The time saved by each source is only reported by Stats, e.g. to
+// find sources which aren't worth caching.
+type Controller struct {
+	// Window is the period over which cost and savings are compared. Older measurements decay exponentially.
+	Window time.Duration
+	// ProbeInterval is how long caching stays disabled before it's re-enabled to check whether it has
+	// become worthwhile.
+	ProbeInterval time.Duration
+	// MinSessions is the number of sessions which must be measured before caching is disabled.
+	MinSessions int
+	// Now returns the current time.
+	Now func() time.Time
+
+	mutex     sync.Mutex
+	disabled  bool
+	changed   time.Time
+	sessions  int
+	cost      rolling
+	saved     rolling
+	sources   map[string]*rolling
+	decisions []Decision
+}
+
+// NewController creates a Controller which compares cost and savings over 5 minutes, and re-checks
+// disabled caching every 15 minutes.
+func NewController() *Controller {
+	return &Controller{
+		Window:        time.Minute * 5,
+		ProbeInterval: time.Minute * 15,
+		MinSessions:   100,
+		Now:           time.Now,
+	}
+}
+
+// maxDecisions is the number of decisions retained for Stats.
+const maxDecisions = 10
+
+// Decision records a change to whether caching is enabled.
+type Decision struct {
+	// Time is when the decision was made.
+	Time time.Time
+	// Enabled is true if caching was enabled.
+	Enabled bool
+	// Reason explains the decision.
+	Reason string
+	// Cost is the rolling cost of caching at the time of the decision.
+	Cost time.Duration
+	// Saved is the rolling time saved by caching at the time of the decision.
+	Saved time.Duration
+}
+
+// Stats shows the current state of the Controller.
+type Stats struct {
+	// Enabled is true when caching is enabled.
+	Enabled bool
+	// Since is when caching was last enabled or disabled.
+	Since time.Time
+	// Sessions is the number of sessions measured since caching was last enabled.
+	Sessions int
+	// Cost is the rolling time spent keeping the cache up-to-date.
+	Cost time.Duration
+	// Saved is the rolling time saved by the cache.
+	Saved time.Duration
+	// SavedBySource is the rolling time saved by the cache, by data source. It isn't used to decide whether
+	// caching is enabled.
+	SavedBySource map[string]time.Duration
+	// Decisions are the most recent decisions, oldest first.
+	Decisions []Decision
+}
+
+// Check returns whether caching is currently enabled. If the decision has changed since the last call, changed
+// is true.
+func (c *Controller) Check() (d Decision, changed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.Now()
+	if c.changed.IsZero() {
+		c.changed = now
+	}
+	cost, saved := c.cost.get(now, c.Window), c.saved.get(now, c.Window)
+	d = Decision{
+		Time:    now,
+		Enabled: !c.disabled,
+		Cost:    time.Duration(cost),
+		Saved:   time.Duration(saved),
+	}
+	switch {
+	case c.disabled && now.Sub(c.changed) >= c.ProbeInterval:
+		d.Enabled = true
+		d.Reason = "probing whether caching has become worthwhile"
+	case !c.disabled && c.sessions >= c.MinSessions && now.Sub(c.changed) >= c.Window && cost > saved:
+		d.Enabled = false
+		d.Reason = "caching cost more time than it saved"
+	default:
+		return
+	}
+	c.record(d)
+	changed = true
+	return
+}
+
+func (c *Controller) record(d Decision) {
+	c.disabled = !d.Enabled
+	c.changed = d.Time
+	c.sessions = 0
+	c.cost = rolling{}
+	c.saved = rolling{}
+	c.sources = nil
+	c.decisions = append(c.decisions, d)
+	if len(c.decisions) > maxDecisions {
+		c.decisions = c.decisions[len(c.decisions)-maxDecisions:]
+	}
+}
+
+// RecordCost records the time spent keeping the cache up-to-date during a session.
+func (c *Controller) RecordCost(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sessions++
+	c.cost.add(c.Now(), c.Window, float64(d))
+}
+
+// RecordSaved records time saved by retrieving an item from the data source from the cache.
+func (c *Controller) RecordSaved(source string, d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.Now()
+	c.saved.add(now, c.Window, float64(d))
+	if c.sources == nil {
+		c.sources = map[string]*rolling{}
+	}
+	r, ok := c.sources[source]
+	if !ok {
+		r = &rolling{}
+		c.sources[source] = r
+	}
+	r.add(now, c.Window, float64(d))
+}
+
+// Stats returns the current state of the Controller.
+func (c *Controller) Stats() (s Stats) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.Now()
+	s.Enabled = !c.disabled
+	s.Since = c.changed
+	s.Sessions = c.sessions
+	s.Cost = time.Duration(c.cost.get(now, c.Window))
+	s.Saved = time.Duration(c.saved.get(now, c.Window))
+	s.SavedBySource = make(map[string]time.Duration, len(c.sources))
+	for k, v := range c.sources {
+		s.SavedBySource[k] = time.Duration(v.get(now, c.Window))
+	}
+	s.Decisions = append([]Decision{}, c.decisions...)
+	return
+}
+
+// rolling is a sum which decays exponentially over time.
+type rolling struct {
+	value   float64
+	updated time.Time
+}
+
+func (r *rolling) add(now time.Time, window time.Duration, v float64) {
+	r.value = r.get(now, window) + v
+	r.updated = now
+}
+
+func (r *rolling) get(now time.Time, window time.Duration) float64 {
+	if r.updated.IsZero() || window <= 0 {
+		return r.value
+	}
+	elapsed := now.Sub(r.updated)
+	if elapsed <= 0 {
+		return r.value
+	}
+	return r.value * math.Exp(-float64(elapsed)/float64(window))
+}
@@ -0,0 +1,169 @@
+package adaptive
+
+import (
+	"testing"
+	"time"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestController() (c *Controller, clk *clock) {
+	clk = &clock{now: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)}
+	c = &Controller{
+		Window:        time.Minute,
+		ProbeInterval: time.Minute * 10,
+		MinSessions:   10,
+		Now:           clk.Now,
+	}
+	return
+}
+
+func TestController(t *testing.T) {
+	tests := []struct {
+		name            string
+		sessions        int
+		cost            time.Duration
+		saved           time.Duration
+		elapsed         time.Duration
+		expectedEnabled bool
+	}{
+		{
+			name:            "caching is enabled by default",
+			expectedEnabled: true,
+		},
+		{
+			name:            "caching stays enabled when it saves more than it costs",
+			sessions:        20,
+			cost:            time.Millisecond,
+			saved:           time.Millisecond * 10,
+			elapsed:         time.Minute,
+			expectedEnabled: true,
+		},
+		{
+			name:            "caching is disabled when it costs more than it saves",
+			sessions:        20,
+			cost:            time.Millisecond * 10,
+			saved:           time.Millisecond,
+			elapsed:         time.Minute,
+			expectedEnabled: false,
+		},
+		{
+			name:            "caching isn't disabled until enough sessions have been measured",
+			sessions:        5,
+			cost:            time.Millisecond * 10,
+			saved:           time.Millisecond,
+			elapsed:         time.Minute,
+			expectedEnabled: true,
+		},
+		{
+			name:            "caching isn't disabled until a full window has been measured",
+			sessions:        20,
+			cost:            time.Millisecond * 10,
+			saved:           time.Millisecond,
+			elapsed:         time.Second,
+			expectedEnabled: true,
+		},
+	}
+
+	for _, test := range tests {
+		c, clk := newTestController()
+		c.Check()
+		for i := 0; i < test.sessions; i++ {
+			c.RecordCost(test.cost)
+			c.RecordSaved("db.table", test.saved)
+		}
+		clk.Advance(test.elapsed)
+		d, changed := c.Check()
+		if d.Enabled != test.expectedEnabled {
+			t.Errorf("%s: expected enabled %v, got %v", test.name, test.expectedEnabled, d.Enabled)
+		}
+		if changed == test.expectedEnabled {
+			t.Errorf("%s: expected changed to be %v", test.name, !test.expectedEnabled)
+		}
+		if s := c.Stats(); s.Enabled != test.expectedEnabled {
+			t.Errorf("%s: expected stats to show enabled %v, got %v", test.name, test.expectedEnabled, s.Enabled)
+		}
+	}
+}
+
+func TestControllerProbesPeriodically(t *testing.T) {
+	c, clk := newTestController()
+	c.Check()
+	for i := 0; i < 20; i++ {
+		c.RecordCost(time.Millisecond)
+	}
+	clk.Advance(time.Minute)
+	if d, _ := c.Check(); d.Enabled {
+		t.Fatalf("expected caching to be disabled")
+	}
+
+	clk.Advance(time.Minute * 5)
+	if d, changed := c.Check(); d.Enabled || changed {
+		t.Errorf("expected caching to remain disabled until the probe interval")
+	}
+
+	clk.Advance(time.Minute * 5)
+	d, changed := c.Check()
+	if !d.Enabled || !changed {
+		t.Errorf("expected caching to be re-enabled after the probe interval")
+	}
+	if d.Reason == "" {
+		t.Errorf("expected the decision to have a reason")
+	}
+
+	s := c.Stats()
+	if len(s.Decisions) != 2 {
+		t.Fatalf("expected 2 decisions, got %d", len(s.Decisions))
+	}
+	if s.Decisions[0].Enabled || !s.Decisions[1].Enabled {
+		t.Errorf("expected the decisions to be disable, then enable, got %+v", s.Decisions)
+	}
+	if s.Sessions != 0 || s.Cost != 0 {
+		t.Errorf("expected the measurements to be reset by the probe, got %+v", s)
+	}
+}
+
+func TestControllerStatsAreBrokenDownBySource(t *testing.T) {
+	c, clk := newTestController()
+	c.RecordSaved("db.a", time.Second)
+	c.RecordSaved("db.a", time.Second)
+	c.RecordSaved("db.b", time.Second)
+
+	s := c.Stats()
+	if s.Saved != time.Second*3 {
+		t.Errorf("expected 3s saved, got %v", s.Saved)
+	}
+	if s.SavedBySource["db.a"] != time.Second*2 {
+		t.Errorf("expected 2s saved from db.a, got %v", s.SavedBySource["db.a"])
+	}
+	if s.SavedBySource["db.b"] != time.Second {
+		t.Errorf("expected 1s saved from db.b, got %v", s.SavedBySource["db.b"])
+	}
+
+	clk.Advance(time.Minute)
+	if s := c.Stats(); s.Saved >= time.Second*3/2 {
+		t.Errorf("expected older measurements to decay, got %v", s.Saved)
+	}
+}
+
+func TestDecaysToZero(t *testing.T) {
+	var r rolling
+	now := time.Now()
+	r.add(now, time.Second, 100)
+	if v := r.get(now, time.Second); v != 100 {
+		t.Errorf("expected 100, got %v", v)
+	}
+	if v := r.get(now.Add(time.Hour), time.Second); v > 0.0001 {
+		t.Errorf("expected the value to decay to zero, got %v", v)
+	}
+}
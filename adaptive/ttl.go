@@ -0,0 +1,159 @@
+package adaptive
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// TTLPolicy chooses how long to cache data from each source, based on how often the source is invalidated
+// and how long it takes to load data from it. Data which rarely changes is cached for up to Max. Data which
+// changes often is cached for a shorter time, or not at all if it's also quick to load.
+type TTLPolicy struct {
+	// Min is the shortest time that data is cached for. If data is expected to change sooner than this, it's
+	// not cached, unless it's slower to load than SlowLoad.
+	Min time.Duration
+	// Max is the longest time that data is cached for. Sources which haven't been invalidated are cached
+	// for this long.
+	Max time.Duration
+	// SlowLoad is the load time at which data is still worth caching for Min, even if it's expected to change
+	// before Min has elapsed.
+	SlowLoad time.Duration
+	// Window is the period over which invalidations and load times are measured. Older measurements decay
+	// exponentially.
+	Window time.Duration
+	// Now returns the current time.
+	Now func() time.Time
+
+	mutex   sync.Mutex
+	sources map[string]*sourceStats
+}
+
+// NewTTLPolicy creates a TTLPolicy which caches data for between min and max, based on invalidations and
+// load times over the last hour.
+func NewTTLPolicy(min, max time.Duration) *TTLPolicy {
+	return &TTLPolicy{
+		Min:      min,
+		Max:      max,
+		SlowLoad: time.Millisecond * 100,
+		Window:   time.Hour,
+		Now:      time.Now,
+	}
+}
+
+// SourceTTL shows the measurements of a data source, and the TTL chosen for it.
+type SourceTTL struct {
+	// InvalidationsPerHour is the rate that data from the source is being invalidated.
+	InvalidationsPerHour float64
+	// Load is the average time taken to load data from the source.
+	Load time.Duration
+	// TTL is how long data from the source will be cached for.
+	TTL time.Duration
+	// Cached is false if data from the source isn't being cached.
+	Cached bool
+}
+
+type sourceStats struct {
+	first         time.Time
+	invalidations rolling
+	loads         rolling
+	loadTime      rolling
+}
+
+func (p *TTLPolicy) get(source string, now time.Time) (s *sourceStats) {
+	if p.sources == nil {
+		p.sources = map[string]*sourceStats{}
+	}
+	s, ok := p.sources[source]
+	if !ok {
+		s = &sourceStats{first: now}
+		p.sources[source] = s
+	}
+	return
+}
+
+// RecordInvalidation records that data from the source has been invalidated.
+func (p *TTLPolicy) RecordInvalidation(source string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.Now()
+	p.get(source, now).invalidations.add(now, p.Window, 1)
+}
+
+// RecordLoad records how long it took to load data from the source.
+func (p *TTLPolicy) RecordLoad(source string, d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.Now()
+	s := p.get(source, now)
+	s.loads.add(now, p.Window, 1)
+	s.loadTime.add(now, p.Window, float64(d))
+}
+
+// TTL returns how long to cache data from the source for. If the data shouldn't be cached, ok is false.
+func (p *TTLPolicy) TTL(source string) (ttl time.Duration, ok bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	s, known := p.sources[source]
+	if !known {
+		return p.Max, true
+	}
+	st := p.ttl(s, p.Now())
+	return st.TTL, st.Cached
+}
+
+// Expiry returns when data from the source, added to the cache now, should expire. Expiry is randomised
+// between 75% and 100% of the TTL to avoid cache runs. If the data shouldn't be cached, ok is false.
+func (p *TTLPolicy) Expiry(source string) (expiry time.Time, ok bool) {
+	ttl, ok := p.TTL(source)
+	if !ok {
+		return
+	}
+	jitter := time.Duration(rand.Int63n(int64(ttl/4) + 1))
+	expiry = p.Now().Add(ttl - jitter)
+	return
+}
+
+// Sources returns the measurements and chosen TTL of each data source that has been seen.
+func (p *TTLPolicy) Sources() map[string]SourceTTL {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.Now()
+	sources := make(map[string]SourceTTL, len(p.sources))
+	for k, s := range p.sources {
+		sources[k] = p.ttl(s, now)
+	}
+	return sources
+}
+
+func (p *TTLPolicy) ttl(s *sourceStats, now time.Time) (st SourceTTL) {
+	if loads := s.loads.get(now, p.Window); loads > 0 {
+		st.Load = time.Duration(s.loadTime.get(now, p.Window) / loads)
+	}
+	// Until a full window has passed, the invalidations have been collected over a shorter period.
+	period := now.Sub(s.first)
+	if period > p.Window {
+		period = p.Window
+	}
+	if period < time.Second {
+		period = time.Second
+	}
+	invalidations := s.invalidations.get(now, p.Window)
+	st.InvalidationsPerHour = invalidations * float64(time.Hour) / float64(period)
+	st.TTL, st.Cached = p.Max, true
+	if invalidations == 0 {
+		return
+	}
+	// Cache for half of the expected time until the next change.
+	if ttl := time.Duration(float64(period) / invalidations / 2); ttl < p.Max {
+		st.TTL = ttl
+	}
+	if st.TTL < p.Min {
+		if st.Load >= p.SlowLoad {
+			st.TTL = p.Min
+			return
+		}
+		st.TTL, st.Cached = 0, false
+	}
+	return
+}
@@ -0,0 +1,92 @@
+package adaptive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		invalidations int
+		load          time.Duration
+		expectedTTL   time.Duration
+		expectedOK    bool
+	}{
+		{
+			name:        "sources which are never invalidated are cached for the maximum time",
+			load:        time.Millisecond,
+			expectedTTL: time.Hour,
+			expectedOK:  true,
+		},
+		{
+			name:          "hourly invalidated sources are cached for half an hour",
+			invalidations: 1,
+			load:          time.Millisecond,
+			expectedTTL:   time.Minute * 30,
+			expectedOK:    true,
+		},
+		{
+			name:          "frequently invalidated sources are cached for half of the expected time between invalidations",
+			invalidations: 60,
+			load:          time.Millisecond,
+			expectedTTL:   time.Minute / 2,
+			expectedOK:    true,
+		},
+		{
+			name:          "volatile sources which are quick to load aren't cached",
+			invalidations: 3600,
+			load:          time.Millisecond,
+			expectedOK:    false,
+		},
+		{
+			name:          "volatile sources which are slow to load are cached for the minimum time",
+			invalidations: 3600,
+			load:          time.Second,
+			expectedTTL:   time.Second * 10,
+			expectedOK:    true,
+		},
+	}
+
+	for _, test := range tests {
+		clk := &clock{now: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)}
+		p := NewTTLPolicy(time.Second*10, time.Hour)
+		p.Window = time.Hour * 24
+		p.Now = clk.Now
+		p.RecordLoad("db.table", test.load)
+		clk.Advance(time.Hour)
+		for i := 0; i < test.invalidations; i++ {
+			p.RecordInvalidation("db.table")
+		}
+		// Measure the invalidations as if they were spread evenly over the hour.
+		p.sources["db.table"].invalidations.updated = clk.now
+		ttl, ok := p.TTL("db.table")
+		if ok != test.expectedOK {
+			t.Errorf("%s: expected ok %v, got %v", test.name, test.expectedOK, ok)
+		}
+		if diff := ttl - test.expectedTTL; diff > time.Second || diff < -time.Second {
+			t.Errorf("%s: expected TTL of %v, got %v", test.name, test.expectedTTL, ttl)
+		}
+		s := p.Sources()["db.table"]
+		if s.TTL != ttl || s.Cached != ok {
+			t.Errorf("%s: expected the TTL to be available for inspection, got %+v", test.name, s)
+		}
+		if s.Load != test.load {
+			t.Errorf("%s: expected load time of %v, got %v", test.name, test.load, s.Load)
+		}
+	}
+}
+
+func TestTTLPolicyUsesTheMaximumForUnknownSources(t *testing.T) {
+	p := NewTTLPolicy(time.Second, time.Minute)
+	if ttl, ok := p.TTL("unknown"); !ok || ttl != time.Minute {
+		t.Errorf("expected the maximum TTL, got %v, %v", ttl, ok)
+	}
+	expiry, ok := p.Expiry("unknown")
+	if !ok {
+		t.Fatalf("expected the data to be cacheable")
+	}
+	if until := expiry.Sub(time.Now()); until < time.Second*44 || until > time.Minute {
+		t.Errorf("expected the expiry to be between 75%% and 100%% of the TTL, got %v", until)
+	}
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"math/rand"
+	"reflect"
 	"sync"
 	"time"
 )
@@ -9,9 +10,10 @@ import (
 // NewCacheItem creates a new cache item.
 func NewCacheItem(item interface{}, expiry time.Time, saved time.Duration) Item {
 	return Item{
-		Value:  item,
-		Expiry: expiry,
-		Saved:  saved,
+		Value:       item,
+		Expiry:      expiry,
+		Saved:       saved,
+		Fingerprint: Fingerprint(reflect.TypeOf(item)),
 	}
 }
 
@@ -23,6 +25,8 @@ type Item struct {
 	Expiry time.Time
 	// Saved is the amount of time saved by getting this item from the cache.
 	Saved time.Duration
+	// Fingerprint identifies the structure of the Value's type at the time it was stored, see Fingerprint.
+	Fingerprint string
 }
 
 // ExpiryFunction is a function which expires entries from the cache based on time.
@@ -69,6 +73,12 @@ func (c *Cache) PutWithDuration(key string, item interface{}, saved time.Duratio
 	c.PutCacheItem(key, NewCacheItem(item, expiryTime, saved))
 }
 
+// PutWithExpiry puts some data into the cache, to expire at a specific time instead of using the cache's
+// Expiration function.
+func (c *Cache) PutWithExpiry(key string, item interface{}, expiry time.Time, saved time.Duration) {
+	c.PutCacheItem(key, NewCacheItem(item, expiry, saved))
+}
+
 // PutCacheItem puts a cache item into memory.
 func (c *Cache) PutCacheItem(key string, item Item) {
 	c.Data.Store(key, item)
@@ -129,6 +139,15 @@ func (c *Cache) RemoveMany(keys ...string) {
 	}
 }
 
+// RemoveAll removes all values from the cache.
+func (c *Cache) RemoveAll() {
+	remover := func(k, v interface{}) bool {
+		c.Data.Delete(k)
+		return true
+	}
+	c.Data.Range(remover)
+}
+
 // Count the number of items in the cache.
 func (c *Cache) Count() (count int) {
 	counter := func(k, v interface{}) bool {
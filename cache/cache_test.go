@@ -33,6 +33,19 @@ func TestCacheItemsCanExpire(t *testing.T) {
 	}
 }
 
+func TestCacheItemsCanHaveTheirOwnExpiry(t *testing.T) {
+	c := New()
+	c.PutWithExpiry("expired", "item", time.Now().Add(time.Second*-1), time.Millisecond)
+	c.PutWithExpiry("current", "item", time.Now().Add(time.Hour), time.Millisecond)
+	c.RemoveExpired()
+	if _, ok := c.Get("expired"); ok {
+		t.Error("expired items should have been removed")
+	}
+	if _, saved, ok := c.GetWithDuration("current"); !ok || saved != time.Millisecond {
+		t.Error("items which haven't expired should be retained")
+	}
+}
+
 func TestCacheItemsCanBeOverwritten(t *testing.T) {
 	c := New()
 	c.Put("key_1", "v1")
@@ -67,6 +80,16 @@ func TestCacheItemsCanBeRemoved(t *testing.T) {
 	}
 }
 
+func TestCacheItemsCanAllBeRemoved(t *testing.T) {
+	c := New()
+	c.Put("key_1", "item")
+	c.Put("key_2", "item")
+	c.RemoveAll()
+	if c.Count() != 0 {
+		t.Errorf("expected to have %d items, but got %d", 0, c.Count())
+	}
+}
+
 func TestCacheItemsCanBeCounted(t *testing.T) {
 	c := New()
 	c.Put("key_1", "item")
@@ -100,3 +123,59 @@ func TestCacheItemsCanBeRetrievedWithTiming(t *testing.T) {
 		t.Errorf("expected 30 seconds, got %v", ts)
 	}
 }
+
+func TestCacheItemsHaveATypeFingerprint(t *testing.T) {
+	type a struct {
+		Name string
+	}
+	type b struct {
+		Name string `json:"name"`
+	}
+	type recursive struct {
+		Children []recursive
+	}
+	tests := []struct {
+		name     string
+		x, y     interface{}
+		expected bool
+	}{
+		{
+			name:     "same types",
+			x:        a{Name: "x"},
+			y:        a{Name: "y"},
+			expected: true,
+		},
+		{
+			name:     "different struct tags",
+			x:        a{},
+			y:        b{},
+			expected: false,
+		},
+		{
+			name:     "value and pointer",
+			x:        a{},
+			y:        &a{},
+			expected: false,
+		},
+		{
+			name:     "recursive types",
+			x:        recursive{},
+			y:        recursive{Children: []recursive{{}}},
+			expected: true,
+		},
+		{
+			name:     "nil",
+			x:        nil,
+			y:        nil,
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		x := NewCacheItem(test.x, time.Now(), 0)
+		y := NewCacheItem(test.y, time.Now(), 0)
+		if actual := x.Fingerprint == y.Fingerprint; actual != test.expected {
+			t.Errorf("%s: expected fingerprints to match: %v, got %v ('%v', '%v')", test.name, test.expected, actual, x.Fingerprint, y.Fingerprint)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/hex"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// fingerprints memoizes Fingerprint, since types don't change while the program is running.
+var fingerprints sync.Map
+
+// Fingerprint identifies the structure of a type, including the names, types and tags of struct fields.
+// Types with the same name but a different structure have different fingerprints.
+func Fingerprint(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	if fp, ok := fingerprints.Load(t); ok {
+		return fp.(string)
+	}
+	var b bytes.Buffer
+	describe(&b, t, map[reflect.Type]bool{})
+	h := fnv.New64a()
+	h.Write(b.Bytes())
+	fp := hex.EncodeToString(h.Sum(nil))
+	fingerprints.Store(t, fp)
+	return fp
+}
+
+func describe(b *bytes.Buffer, t reflect.Type, seen map[reflect.Type]bool) {
+	if t.Name() != "" {
+		b.WriteString(t.PkgPath() + "." + t.Name() + ":")
+		if seen[t] {
+			// Recursive types only need to be described once.
+			return
+		}
+		seen[t] = true
+	}
+	b.WriteString(t.Kind().String())
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		b.WriteString("(")
+		describe(b, t.Elem(), seen)
+		b.WriteString(")")
+	case reflect.Array:
+		b.WriteString("[" + strconv.Itoa(t.Len()) + "](")
+		describe(b, t.Elem(), seen)
+		b.WriteString(")")
+	case reflect.Chan:
+		b.WriteString(t.ChanDir().String() + "(")
+		describe(b, t.Elem(), seen)
+		b.WriteString(")")
+	case reflect.Map:
+		b.WriteString("[")
+		describe(b, t.Key(), seen)
+		b.WriteString("](")
+		describe(b, t.Elem(), seen)
+		b.WriteString(")")
+	case reflect.Struct:
+		b.WriteString("{")
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			b.WriteString(f.Name + " ")
+			describe(b, f.Type, seen)
+			b.WriteString(" " + strconv.Quote(string(f.Tag)) + ";")
+		}
+		b.WriteString("}")
+	case reflect.Func:
+		b.WriteString("(")
+		for i := 0; i < t.NumIn(); i++ {
+			describe(b, t.In(i), seen)
+			b.WriteString(",")
+		}
+		b.WriteString(")(")
+		for i := 0; i < t.NumOut(); i++ {
+			describe(b, t.Out(i), seen)
+			b.WriteString(",")
+		}
+		b.WriteString(")")
+	case reflect.Interface:
+		b.WriteString("{")
+		for i := 0; i < t.NumMethod(); i++ {
+			m := t.Method(i)
+			b.WriteString(m.Name + " ")
+			describe(b, m.Type, seen)
+			b.WriteString(";")
+		}
+		b.WriteString("}")
+	}
+}
@@ -1,15 +1,26 @@
 package changes
 
-import "github.com/a-h/scache/data"
+import (
+	"context"
+
+	"github.com/a-h/scache/data"
+)
 
 // Notifier notifies listeners of changes.
 type Notifier struct {
-	s StreamPutter
+	s        StreamPutter
+	producer string
 }
 
 // StreamPutter defines the requirements for informing consumers of changes.
 type StreamPutter interface {
-	Put(keys []string) error
+	Put(ctx context.Context, keys []string) error
+}
+
+// ProducerStreamPutter is implemented by streams which can tag records with the ID of the Observer which
+// should skip them, see ReaderStreamGetter.
+type ProducerStreamPutter interface {
+	PutFrom(ctx context.Context, producer string, keys []string) error
 }
 
 // NewNotifier creates a way of notifying consumers of changes.
@@ -19,20 +30,36 @@ func NewNotifier(s StreamPutter) Notifier {
 	}
 }
 
+// NewNotifierFor creates a Notifier whose changes are skipped by the Observer, because the Observer's
+// cache is updated when the change is made. Other Observers of the stream still read the changes.
+func NewNotifierFor(s StreamPutter, o *Observer) Notifier {
+	return Notifier{
+		s:        s,
+		producer: o.ID(),
+	}
+}
+
+func (n Notifier) put(ctx context.Context, keys []string) error {
+	if ps, ok := n.s.(ProducerStreamPutter); ok && n.producer != "" {
+		return ps.PutFrom(ctx, n.producer, keys)
+	}
+	return n.s.Put(ctx, keys)
+}
+
 // NotifyObservablesChanged notifies consumers of changes to data items.
-func (n Notifier) NotifyObservablesChanged(changesTo ...Observable) error {
+func (n Notifier) NotifyObservablesChanged(ctx context.Context, changesTo ...Observable) error {
 	keys := make([]string, len(changesTo))
 	for i, changed := range changesTo {
 		keys[i] = changed.ObservableID().String()
 	}
-	return n.s.Put(keys)
+	return n.put(ctx, keys)
 }
 
 // NotifyDataChanged notifies consumers of changes to data items.
-func (n Notifier) NotifyDataChanged(changed ...data.ID) error {
+func (n Notifier) NotifyDataChanged(ctx context.Context, changed ...data.ID) error {
 	keys := make([]string, len(changed))
 	for i, id := range changed {
 		keys[i] = id.String()
 	}
-	return n.s.Put(keys)
+	return n.put(ctx, keys)
 }
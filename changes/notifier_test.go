@@ -1,6 +1,7 @@
 package changes
 
 import (
+	"context"
 	"reflect"
 	"strconv"
 	"testing"
@@ -13,7 +14,7 @@ type MockStreamPutter struct {
 	PutCallCount int
 }
 
-func (msp *MockStreamPutter) Put(keys []string) error {
+func (msp *MockStreamPutter) Put(ctx context.Context, keys []string) error {
 	defer func() { msp.PutCallCount++ }()
 	return msp.PutFuncs[msp.PutCallCount](keys)
 }
@@ -69,12 +70,49 @@ func TestNotifier(t *testing.T) {
 		},
 	}
 
-	err := n.NotifyObservablesChanged(records...)
+	err := n.NotifyObservablesChanged(context.Background(), records...)
 	if err != nil {
 		t.Errorf("unexpected error on NotifyObservablesChanged: %v", err)
 	}
-	err = n.NotifyDataChanged(id3, id4)
+	err = n.NotifyDataChanged(context.Background(), id3, id4)
 	if err != nil {
 		t.Errorf("unexpected error on NotifyDataChanged: %v", err)
 	}
 }
+
+type MockProducerStreamPutter struct {
+	*MockStreamPutter
+	PutFromFunc func(producer string, keys []string) error
+}
+
+func (mpsp MockProducerStreamPutter) PutFrom(ctx context.Context, producer string, keys []string) error {
+	return mpsp.PutFromFunc(producer, keys)
+}
+
+func TestNotifierForAnObserverTagsItsChanges(t *testing.T) {
+	var producers []string
+	putter := MockProducerStreamPutter{
+		MockStreamPutter: &MockStreamPutter{
+			PutFuncs: []func(keys []string) error{
+				func(keys []string) error { return nil },
+			},
+		},
+		PutFromFunc: func(producer string, keys []string) error {
+			producers = append(producers, producer)
+			return nil
+		},
+	}
+	o := NewObserver(&MockStreamGetter{})
+	if err := NewNotifierFor(putter, o).NotifyDataChanged(context.Background(), data.NewID("db.table.id", "1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := NewNotifier(putter).NotifyDataChanged(context.Background(), data.NewID("db.table.id", "1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(producers, []string{o.ID()}) {
+		t.Errorf("expected the changes to be tagged with the observer's ID, got %v", producers)
+	}
+	if putter.PutCallCount != 1 {
+		t.Errorf("expected changes from other notifiers not to be tagged, got %d calls to Put", putter.PutCallCount)
+	}
+}
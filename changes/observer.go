@@ -2,9 +2,13 @@ package changes
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/a-h/scache/data"
 
@@ -14,34 +18,88 @@ import (
 // Observer reads a stream for changes, handling state.
 type Observer struct {
 	s     StreamGetter
+	id    string
 	pos   expiry.StreamPosition
 	mutex sync.Mutex
 }
 
-// StreamGetter defines the requirements for informing consumers of changes.
+// StreamGetter defines the requirements for informing consumers of changes. If the context is done before
+// Get completes, Get should return the keys read so far, the position after them, and the context's error,
+// so that reading can resume from there.
 type StreamGetter interface {
-	Get(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error)
+	Get(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error)
+}
+
+// ReaderStreamGetter is implemented by streams which keep state for each reader. If the stream implements
+// it, the Observer calls GetFor in place of Get, so that records written by a Notifier created with
+// NewNotifierFor are skipped by its Observer, and duplicate records are ignored by each reader separately.
+type ReaderStreamGetter interface {
+	GetFor(ctx context.Context, reader string, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error)
+}
+
+// StreamAnchor is implemented by streams which can find their position at a point in time.
+type StreamAnchor interface {
+	// Anchor returns a position which reads everything added to the stream since at.
+	Anchor(ctx context.Context, at time.Time) (pos expiry.StreamPosition, err error)
 }
 
 // NewObserver creates a way of keeping up-to-date with a stream.
 func NewObserver(s StreamGetter) *Observer {
 	return &Observer{
 		s:     s,
+		id:    newID(),
 		pos:   map[expiry.ShardID]expiry.SequenceNumber{},
 		mutex: sync.Mutex{},
 	}
 }
 
-// Observe gets all changes to the stream since the last call.
-func (o *Observer) Observe() (op []data.ID, err error) {
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ID uniquely identifies the Observer to streams which implement ReaderStreamGetter.
+func (o *Observer) ID() string {
+	return o.id
+}
+
+func (o *Observer) get(ctx context.Context) (keys []string, to expiry.StreamPosition, err error) {
+	if rs, ok := o.s.(ReaderStreamGetter); ok && o.id != "" {
+		return rs.GetFor(ctx, o.id, o.pos)
+	}
+	return o.s.Get(ctx, o.pos)
+}
+
+// Observe gets all changes to the stream since the last call. If the position has expired from the stream,
+// or there are too many changes to read, the position is reset, and the *expiry.PositionExpiredError or
+// *expiry.BacklogExceededError is returned, so that the cache can be flushed. If the context is done before
+// all of the changes have been read, the changes read so far are returned with an error, and the next call
+// continues from where reading stopped.
+func (o *Observer) Observe(ctx context.Context) (op []data.ID, err error) {
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
-	si, to, err := o.s.Get(o.pos)
-	if err != nil {
-		err = errors.New("observer: could not get from stream: " + err.Error())
+	si, to, err := o.get(ctx)
+	switch err.(type) {
+	case *expiry.PositionExpiredError, *expiry.BacklogExceededError:
+		// Changes may have been missed, so start again from now, and let the caller flush the cache. If the
+		// stream can't be anchored, the next call starts from the latest message.
+		o.anchor(ctx)
 		return
 	}
 	var errs []error
+	if err != nil {
+		if err != ctx.Err() {
+			err = errors.New("observer: could not get from stream: " + err.Error())
+			return
+		}
+		errs = append(errs, errors.New("stopped reading stream: "+err.Error()))
+		err = nil
+		if to == nil {
+			// Nothing was read.
+			to = o.pos
+		}
+	}
 	for _, s := range si {
 		id, parseErr := data.Parse(s)
 		if parseErr != nil {
@@ -69,10 +127,28 @@ func join(errs []error) (err error) {
 	return
 }
 
-// Reset sets the position of the stream to the latest message. Used when no data is cached, so being
-// notified of changes isn't required.
-func (o *Observer) Reset() {
+// Reset moves the position of the stream to the current time. Used when no data is cached, so the changes
+// before now aren't required. If the stream implements StreamAnchor, changes made after the call to Reset
+// are returned by the next call to Observe. Otherwise, the next call to Observe starts from the latest
+// message, and any changes made in between are missed.
+func (o *Observer) Reset(ctx context.Context) (err error) {
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
+	return o.anchor(ctx)
+}
+
+// anchor moves the position of the stream to the current time. The caller must hold the mutex.
+func (o *Observer) anchor(ctx context.Context) (err error) {
 	o.pos = map[expiry.ShardID]expiry.SequenceNumber{}
+	a, ok := o.s.(StreamAnchor)
+	if !ok {
+		return
+	}
+	pos, err := a.Anchor(ctx, time.Now())
+	if err != nil {
+		err = errors.New("observer: could not anchor stream: " + err.Error())
+		return
+	}
+	o.pos = pos
+	return
 }
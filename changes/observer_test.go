@@ -1,9 +1,11 @@
 package changes
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/a-h/scache/data"
 	"github.com/a-h/scache/expiry"
@@ -14,7 +16,7 @@ type MockStreamGetter struct {
 	GetCallCount int
 }
 
-func (msg *MockStreamGetter) Get(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+func (msg *MockStreamGetter) Get(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
 	defer func() { msg.GetCallCount++ }()
 	return msg.GetFuncs[msg.GetCallCount](from)
 }
@@ -72,7 +74,7 @@ func TestThatTheStreamPositionIsUpdated(t *testing.T) {
 
 	o := NewObserver(getter)
 	// Read from the latest position.
-	ids, err := o.Observe()
+	ids, err := o.Observe(context.Background())
 	if err != nil {
 		t.Fatalf("unexpected error observing stream (#1): %v", err)
 	}
@@ -81,7 +83,7 @@ func TestThatTheStreamPositionIsUpdated(t *testing.T) {
 		t.Errorf("after first observation, expected %v, got: %v", expected, ids)
 	}
 	// Continue reading.
-	ids, err = o.Observe()
+	ids, err = o.Observe(context.Background())
 	if err != nil {
 		t.Fatalf("unexpected error observing stream (#2): %v", err)
 	}
@@ -90,8 +92,8 @@ func TestThatTheStreamPositionIsUpdated(t *testing.T) {
 		t.Errorf("after second observation, expected %v, got: %v", expected, ids)
 	}
 	// Reset the stream to the latest data and read again.
-	o.Reset()
-	_, err = o.Observe()
+	o.Reset(context.Background())
+	_, err = o.Observe(context.Background())
 	if err != nil {
 		t.Fatalf("unexpected error observing stream (#3): %v", err)
 	}
@@ -113,7 +115,7 @@ func TestThatObservervationMergesParseErrors(t *testing.T) {
 
 	o := NewObserver(getter)
 	// Read from the latest position.
-	ids, err := o.Observe()
+	ids, err := o.Observe(context.Background())
 	expectedErr := "observer: data.ID: value is not a data ID 'something we can't parse', data.ID: value is not a data ID 'some more bad stuff'"
 	if err == nil || err.Error() != expectedErr {
 		t.Fatalf("unexpected error observing stream: %v", err)
@@ -135,9 +137,193 @@ func TestObservationErrors(t *testing.T) {
 	}
 
 	o := NewObserver(getter)
-	_, err := o.Observe()
+	_, err := o.Observe(context.Background())
 	expectedErr := "observer: could not get from stream: network error"
 	if err == nil || err.Error() != expectedErr {
 		t.Fatalf("unexpected error observing stream: %v", err)
 	}
 }
+
+type MockAnchoringStreamGetter struct {
+	*MockStreamGetter
+	AnchorFunc func(at time.Time) (pos expiry.StreamPosition, err error)
+}
+
+func (masg MockAnchoringStreamGetter) Anchor(ctx context.Context, at time.Time) (pos expiry.StreamPosition, err error) {
+	return masg.AnchorFunc(at)
+}
+
+func TestResetAnchorsTheStreamWhenSupported(t *testing.T) {
+	id1 := data.NewID("db1.table1.id", "1")
+	anchor := expiry.StreamPosition{"shard_1": "5"}
+	getter := MockAnchoringStreamGetter{
+		MockStreamGetter: &MockStreamGetter{
+			GetFuncs: []func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error){
+				func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+					if !reflect.DeepEqual(from, anchor) {
+						t.Errorf("expected to read from the anchor %v, got %v", anchor, from)
+					}
+					keys = []string{id1.String()}
+					to = expiry.StreamPosition{"shard_1": "6"}
+					return
+				},
+			},
+		},
+		AnchorFunc: func(at time.Time) (pos expiry.StreamPosition, err error) {
+			if time.Since(at) > time.Minute {
+				t.Errorf("expected to anchor at the current time, got %v", at)
+			}
+			return anchor, nil
+		},
+	}
+
+	o := NewObserver(getter)
+	if err := o.Reset(context.Background()); err != nil {
+		t.Fatalf("unexpected error resetting: %v", err)
+	}
+	// Changes made since the reset are returned.
+	ids, err := o.Observe(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error observing stream: %v", err)
+	}
+	if !reflect.DeepEqual(ids, []data.ID{id1}) {
+		t.Errorf("expected %v, got %v", []data.ID{id1}, ids)
+	}
+}
+
+func TestResetErrors(t *testing.T) {
+	getter := MockAnchoringStreamGetter{
+		MockStreamGetter: &MockStreamGetter{},
+		AnchorFunc: func(at time.Time) (pos expiry.StreamPosition, err error) {
+			err = errors.New("network error")
+			return
+		},
+	}
+
+	o := NewObserver(getter)
+	err := o.Reset(context.Background())
+	expectedErr := "observer: could not anchor stream: network error"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatalf("unexpected error resetting: %v", err)
+	}
+	if len(o.pos) != 0 {
+		t.Errorf("expected the position to be cleared, got %v", o.pos)
+	}
+}
+
+func TestObserverIsAnchoredAgainWhenThePositionExpires(t *testing.T) {
+	anchor := expiry.StreamPosition{"shard_1": "10"}
+	expired := &expiry.PositionExpiredError{Shard: "shard_1", Position: "1", Err: errors.New("trimmed")}
+	getter := MockAnchoringStreamGetter{
+		MockStreamGetter: &MockStreamGetter{
+			GetFuncs: []func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error){
+				func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+					err = expired
+					return
+				},
+				func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+					if !reflect.DeepEqual(from, anchor) {
+						t.Errorf("expected to read from the new anchor %v, got %v", anchor, from)
+					}
+					return
+				},
+			},
+		},
+		AnchorFunc: func(at time.Time) (pos expiry.StreamPosition, err error) {
+			return anchor, nil
+		},
+	}
+
+	o := NewObserver(getter)
+	o.pos = expiry.StreamPosition{"shard_1": "1"}
+	if _, err := o.Observe(context.Background()); err != expired {
+		t.Errorf("expected the expired position error to be returned, got %v", err)
+	}
+	if _, err := o.Observe(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestObserverIsAnchoredAgainWhenTheBacklogIsSkipped(t *testing.T) {
+	anchor := expiry.StreamPosition{"shard_1": "10"}
+	getter := MockAnchoringStreamGetter{
+		MockStreamGetter: &MockStreamGetter{
+			GetFuncs: []func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error){
+				func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+					err = &expiry.BacklogExceededError{Reason: "behind"}
+					return
+				},
+			},
+		},
+		AnchorFunc: func(at time.Time) (pos expiry.StreamPosition, err error) {
+			return anchor, nil
+		},
+	}
+
+	o := NewObserver(getter)
+	o.pos = expiry.StreamPosition{"shard_1": "1"}
+	if _, err := o.Observe(context.Background()); err == nil {
+		t.Error("expected the backlog error to be returned")
+	}
+	if !reflect.DeepEqual(o.pos, anchor) {
+		t.Errorf("expected the position to move to the anchor %v, got %v", anchor, o.pos)
+	}
+}
+
+func TestObserverContinuesFromWhereItStoppedWhenTheContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	partial := expiry.StreamPosition{"shard_1": "5"}
+	getter := &MockStreamGetter{
+		GetFuncs: []func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error){
+			func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+				return []string{data.NewID("db.table.id", "1").String()}, partial, ctx.Err()
+			},
+			func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+				if !reflect.DeepEqual(from, partial) {
+					t.Errorf("expected to continue from %v, got %v", partial, from)
+				}
+				return nil, from, nil
+			},
+		},
+	}
+
+	o := NewObserver(getter)
+	o.pos = expiry.StreamPosition{"shard_1": "1"}
+	ids, err := o.Observe(ctx)
+	if err == nil {
+		t.Error("expected an error when reading stopped early")
+	}
+	if len(ids) != 1 {
+		t.Errorf("expected the changes read before stopping to be returned, got %v", ids)
+	}
+	if _, err := o.Observe(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type MockReaderStreamGetter struct {
+	*MockStreamGetter
+	GetForFunc func(reader string, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error)
+}
+
+func (mrsg MockReaderStreamGetter) GetFor(ctx context.Context, reader string, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	return mrsg.GetForFunc(reader, from)
+}
+
+func TestObserversReadAsThemselvesWhenSupported(t *testing.T) {
+	var readers []string
+	getter := MockReaderStreamGetter{
+		MockStreamGetter: &MockStreamGetter{},
+		GetForFunc: func(reader string, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+			readers = append(readers, reader)
+			return nil, from, nil
+		},
+	}
+	a, b := NewObserver(getter), NewObserver(getter)
+	a.Observe(context.Background())
+	b.Observe(context.Background())
+	if len(readers) != 2 || readers[0] != a.ID() || readers[1] != b.ID() || a.ID() == b.ID() {
+		t.Errorf("expected each observer to read as itself, got %v", readers)
+	}
+}
@@ -0,0 +1,61 @@
+package scache
+
+import (
+	"context"
+	"time"
+)
+
+// Consistency defines how the middleware behaves when the invalidation stream can't be read.
+type Consistency int
+
+const (
+	// FailOpen logs errors reading the stream and continues to serve the cache. This is the default.
+	FailOpen Consistency = iota
+	// FailClosed flushes the cache when the stream can't be read, and bypasses the cache until the
+	// stream can be read again.
+	FailClosed
+	// BoundedStaleness serves the cache only while the last successful read of the stream is more recent
+	// than the engine's MaxStaleness.
+	BoundedStaleness
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case FailOpen:
+		return "FailOpen"
+	case FailClosed:
+		return "FailClosed"
+	case BoundedStaleness:
+		return "BoundedStaleness"
+	}
+	return "Unknown"
+}
+
+// ConsistencyState is the state of the cache during the current request.
+type ConsistencyState struct {
+	// Consistency is the active consistency policy.
+	Consistency Consistency
+	// Bypassed is true when the cache isn't being used for this request. Get will always miss, and Add
+	// won't store anything.
+	Bypassed bool
+	// Disabled is true when the cache is bypassed because the engine's Controller has determined that
+	// caching costs more time than it saves.
+	Disabled bool
+	// PositionExpired is true when the engine's position in the stream had expired, so the cache was
+	// flushed, and reading restarted from the current position.
+	PositionExpired bool
+	// BacklogSkipped is true when the backlog of the stream was too large to read, so the cache was
+	// flushed, and reading restarted from the current position.
+	BacklogSkipped bool
+	// LastObserved is the time when the stream was last read successfully.
+	LastObserved time.Time
+	// Err is the error encountered reading the stream for this request, if any.
+	Err error
+}
+
+// GetConsistencyFromContext gets the state of the cache for the current request.
+func GetConsistencyFromContext(ctx context.Context) (s ConsistencyState, ok bool) {
+	ss, ok := FromContext(ctx)
+	s = ss.Consistency()
+	return
+}
@@ -0,0 +1,68 @@
+package dynamostream
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+
+	"github.com/a-h/scache/expiry"
+)
+
+// iteratorPrefix marks a position which holds a shard iterator, rather than a sequence number. Shards which
+// are read from the latest record have no sequence number until a record is written, so the iterator
+// returned by the read is kept in the position instead, and the next read continues from it.
+const iteratorPrefix = "ITERATOR:"
+
+func iteratorPosition(iterator string) expiry.SequenceNumber {
+	return expiry.SequenceNumber(iteratorPrefix + iterator)
+}
+
+// heldIterator returns the shard iterator held by the position, if any.
+func heldIterator(sn expiry.SequenceNumber) (itr string, ok bool) {
+	if !strings.HasPrefix(string(sn), iteratorPrefix) {
+		return
+	}
+	return strings.TrimPrefix(string(sn), iteratorPrefix), true
+}
+
+// shardRead describes how Get reads a shard.
+type shardRead struct {
+	shard *dynamodbstreams.Shard
+	// from is the sequence number of the last record read, or an iterator position, if any.
+	from expiry.SequenceNumber
+	// trimHorizon is true if the shard should be read from its first record.
+	trimHorizon bool
+}
+
+// planReads decides which shards to read, and where to read them from, using expiry.PlanReads. DynamoDB
+// creates new child shards every few hours.
+func planReads(shards []*dynamodbstreams.Shard, from expiry.StreamPosition) (reads []shardRead, to expiry.StreamPosition) {
+	ds := make([]expiry.Shard, len(shards))
+	byID := make(map[expiry.ShardID]*dynamodbstreams.Shard, len(shards))
+	for i, s := range shards {
+		ds[i] = expiry.Shard{ID: shardID(s), EndingSequenceNumber: endingSequenceNumber(s)}
+		if parent := aws.StringValue(s.ParentShardId); parent != "" {
+			ds[i].Parents = []expiry.ShardID{expiry.ShardID(parent)}
+		}
+		byID[ds[i].ID] = s
+	}
+	planned, to := expiry.PlanReads(ds, from)
+	for _, r := range planned {
+		reads = append(reads, shardRead{shard: byID[r.Shard], from: r.From, trimHorizon: r.TrimHorizon})
+	}
+	return
+}
+
+func shardID(s *dynamodbstreams.Shard) expiry.ShardID {
+	return expiry.ShardID(aws.StringValue(s.ShardId))
+}
+
+// endingSequenceNumber returns the last sequence number of a closed shard, or an empty string if the shard
+// is open.
+func endingSequenceNumber(s *dynamodbstreams.Shard) expiry.SequenceNumber {
+	if s.SequenceNumberRange == nil {
+		return ""
+	}
+	return expiry.SequenceNumber(aws.StringValue(s.SequenceNumberRange.EndingSequenceNumber))
+}
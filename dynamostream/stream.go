@@ -0,0 +1,310 @@
+package dynamostream
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+
+	"github.com/a-h/scache/data"
+	"github.com/a-h/scache/expiry"
+)
+
+// Client contains the DynamoDB Streams functionality used by the Stream.
+type Client interface {
+	DescribeStreamWithContext(ctx aws.Context, input *dynamodbstreams.DescribeStreamInput, opts ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIteratorWithContext(ctx aws.Context, input *dynamodbstreams.GetShardIteratorInput, opts ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecordsWithContext(ctx aws.Context, input *dynamodbstreams.GetRecordsInput, opts ...request.Option) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+// Mapper converts the table name and key attributes of a changed DynamoDB item into the IDs of the cached data
+// which should be invalidated.
+type Mapper func(table string, keys map[string]*dynamodb.AttributeValue) (ids []data.ID, err error)
+
+// Stream reads the changes made to a DynamoDB table from its stream, and returns the IDs of the changed data,
+// so that it can be used by a changes.Observer. Writers don't need to publish invalidations, since every
+// INSERT, MODIFY and REMOVE is read from the stream, so Put does nothing.
+type Stream struct {
+	// StreamARN is the ARN of the table's stream.
+	StreamARN string
+	// Mapper converts changed items into data IDs.
+	Mapper Mapper
+	Client Client
+}
+
+// NewStream creates a Stream which reads the DynamoDB stream.
+func NewStream(region, streamARN string, m Mapper) (g Stream, err error) {
+	conf := &aws.Config{
+		Region: aws.String(region),
+	}
+	sess, err := session.NewSession(conf)
+	if err != nil {
+		return
+	}
+	g = Stream{
+		StreamARN: streamARN,
+		Mapper:    m,
+		Client:    dynamodbstreams.New(sess),
+	}
+	return
+}
+
+// Put does nothing, because changes to the table are written to its stream by DynamoDB.
+func (s Stream) Put(ctx context.Context, keys []string) error {
+	return nil
+}
+
+// ErrUnsupportedKeyType is returned by KeyMapper when a key attribute isn't a string, number or binary value.
+var ErrUnsupportedKeyType = errors.New("dynamostream: key attributes must be strings, numbers or binary")
+
+// KeyMapper creates a Mapper which uses the table's name and key attributes to create a data ID. An item in
+// the "users" table with a hash key of "id" maps to data.NewID(prefix + ".users.id", value). Composite keys
+// are sorted by attribute name, and joined, e.g. data.NewID(prefix + ".orders.id.line", "123/1").
+func KeyMapper(prefix string) Mapper {
+	return func(table string, keys map[string]*dynamodb.AttributeValue) (ids []data.ID, err error) {
+		names := make([]string, 0, len(keys))
+		for k := range keys {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		values := make([]string, len(names))
+		for i, n := range names {
+			if values[i], err = keyValue(keys[n]); err != nil {
+				return
+			}
+		}
+		source := strings.Join(append([]string{prefix, table}, names...), ".")
+		ids = []data.ID{data.NewID(source, strings.Join(values, "/"))}
+		return
+	}
+}
+
+func keyValue(v *dynamodb.AttributeValue) (value string, err error) {
+	switch {
+	case v == nil:
+		err = ErrUnsupportedKeyType
+	case v.S != nil:
+		value = *v.S
+	case v.N != nil:
+		value = *v.N
+	case v.B != nil:
+		value = base64.StdEncoding.EncodeToString(v.B)
+	default:
+		err = ErrUnsupportedKeyType
+	}
+	return
+}
+
+// Get returns the IDs of all of the data changed since the StreamPosition. Shards without a position are
+// read from the latest record, and since a shard has no sequence number until a record is written to it,
+// the iterator returned by the read is kept in the position until then. New child shards are read from
+// their first record once their parent has been read to the end, see expiry.PlanReads. If a position has
+// been trimmed from the stream, a *expiry.PositionExpiredError is returned. If the context is done before
+// every shard has been read, the keys and position read so far are returned with its error.
+func (s Stream) Get(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	table, shards, err := s.describe(ctx)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("dynamostream: failed to describe stream: %v", err)
+		return
+	}
+	reads, to := planReads(shards, from)
+	for _, sr := range reads {
+		var records []*dynamodbstreams.Record
+		var pos expiry.SequenceNumber
+		records, pos, err = s.getRecords(ctx, sr)
+		if err != nil && err != ctx.Err() {
+			return
+		}
+		if pos != "" {
+			to[shardID(sr.shard)] = pos
+		}
+		for _, r := range records {
+			var ids []data.ID
+			if ids, err = s.mapRecord(table, r); err != nil {
+				return
+			}
+			for _, id := range ids {
+				keys = append(keys, id.String())
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			// The shards which haven't been read keep their positions.
+			return
+		}
+	}
+	return
+}
+
+// Anchor returns a position which holds an iterator at the latest record of each open shard, so that the
+// next call to Get reads the changes made after the call to Anchor. Changes made between at and the call
+// are missed. DynamoDB Streams don't support reading from a point in time.
+func (s Stream) Anchor(ctx context.Context, at time.Time) (pos expiry.StreamPosition, err error) {
+	_, shards, err := s.describe(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		err = fmt.Errorf("dynamostream: failed to describe stream: %v", err)
+		return
+	}
+	pos = expiry.StreamPosition{}
+	for _, shard := range shards {
+		if endingSequenceNumber(shard) != "" {
+			continue
+		}
+		var itr *string
+		if itr, err = s.getIterator(ctx, shardRead{shard: shard}); err != nil {
+			return
+		}
+		if itr != nil {
+			pos[shardID(shard)] = iteratorPosition(*itr)
+		}
+	}
+	return
+}
+
+func (s Stream) describe(ctx context.Context) (table string, shards []*dynamodbstreams.Shard, err error) {
+	var start *string
+	for {
+		var dso *dynamodbstreams.DescribeStreamOutput
+		dso, err = s.Client.DescribeStreamWithContext(ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             aws.String(s.StreamARN),
+			ExclusiveStartShardId: start,
+		})
+		if err != nil {
+			return
+		}
+		if dso.StreamDescription == nil {
+			return
+		}
+		table = aws.StringValue(dso.StreamDescription.TableName)
+		shards = append(shards, dso.StreamDescription.Shards...)
+		if dso.StreamDescription.LastEvaluatedShardId == nil {
+			return
+		}
+		start = dso.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// getRecords reads the shard until there are no more records. to is the sequence number of the last record
+// read, the iterator to continue from if the shard has no sequence number yet, or expiry.ShardEnd once a
+// closed shard has been read to the end.
+func (s Stream) getRecords(ctx context.Context, sr shardRead) (records []*dynamodbstreams.Record, to expiry.SequenceNumber, err error) {
+	to = sr.from
+	current, held := heldIteratorPtr(sr.from)
+	if !held {
+		if current, err = s.getIterator(ctx, sr); err != nil {
+			return
+		}
+	}
+	for current != nil {
+		var gro *dynamodbstreams.GetRecordsOutput
+		gro, err = s.Client.GetRecordsWithContext(ctx, &dynamodbstreams.GetRecordsInput{ShardIterator: current})
+		if ctx.Err() != nil {
+			// Keep the records read from earlier pages.
+			err = ctx.Err()
+			return
+		}
+		if aerr, isAWSError := err.(awserr.Error); isAWSError && aerr.Code() == dynamodbstreams.ErrCodeExpiredIteratorException && held {
+			// The iterator was kept for longer than DynamoDB allows. Records may have been written since it
+			// was created, so the shard is read from its first record.
+			held = false
+			if current, err = s.getIterator(ctx, shardRead{shard: sr.shard, trimHorizon: true}); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			err = fmt.Errorf("dynamostream: failed to get records for shard '%v' (from '%v'): %v", shardID(sr.shard), sr.from, err)
+			return
+		}
+		for _, r := range gro.Records {
+			records = append(records, r)
+			if r.Dynamodb != nil && r.Dynamodb.SequenceNumber != nil {
+				to = expiry.SequenceNumber(*r.Dynamodb.SequenceNumber)
+			}
+		}
+		current = gro.NextShardIterator
+		if current == nil {
+			// The shard is closed, and has been read to the end.
+			to = expiry.ShardEnd
+			break
+		}
+		if len(gro.Records) == 0 {
+			if _, isIterator := heldIterator(to); to == "" || isIterator {
+				to = iteratorPosition(*current)
+			}
+			break
+		}
+	}
+	return
+}
+
+func heldIteratorPtr(sn expiry.SequenceNumber) (itr *string, ok bool) {
+	s, ok := heldIterator(sn)
+	if ok {
+		itr = aws.String(s)
+	}
+	return
+}
+
+func (s Stream) getIterator(ctx context.Context, sr shardRead) (itr *string, err error) {
+	gsii := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(s.StreamARN),
+		ShardId:           sr.shard.ShardId,
+		ShardIteratorType: aws.String(dynamodbstreams.ShardIteratorTypeLatest),
+	}
+	switch {
+	case sr.from != "":
+		gsii.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeAfterSequenceNumber)
+		gsii.SequenceNumber = aws.String(string(sr.from))
+	case sr.trimHorizon:
+		gsii.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon)
+	}
+	gsio, err := s.Client.GetShardIteratorWithContext(ctx, gsii)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+	if aerr, isAWSError := err.(awserr.Error); isAWSError && aerr.Code() == dynamodbstreams.ErrCodeTrimmedDataAccessException && sr.from != "" {
+		err = &expiry.PositionExpiredError{Shard: shardID(sr.shard), Position: sr.from, Err: err}
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("dynamostream: failed to get iterator for shard '%v': %v", shardID(sr.shard), err)
+		return
+	}
+	itr = gsio.ShardIterator
+	return
+}
+
+func (s Stream) mapRecord(table string, r *dynamodbstreams.Record) (ids []data.ID, err error) {
+	switch aws.StringValue(r.EventName) {
+	case dynamodbstreams.OperationTypeInsert, dynamodbstreams.OperationTypeModify, dynamodbstreams.OperationTypeRemove:
+	default:
+		return
+	}
+	if r.Dynamodb == nil || len(r.Dynamodb.Keys) == 0 {
+		return
+	}
+	ids, err = s.Mapper(table, r.Dynamodb.Keys)
+	if err != nil {
+		err = fmt.Errorf("dynamostream: failed to map record '%v': %v", aws.StringValue(r.EventID), err)
+	}
+	return
+}
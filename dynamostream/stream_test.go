@@ -0,0 +1,491 @@
+package dynamostream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+
+	"github.com/a-h/scache/data"
+	"github.com/a-h/scache/expiry"
+)
+
+type TestClient struct {
+	DescribeStreamFunc   func(input *dynamodbstreams.DescribeStreamInput) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIteratorFunc func(input *dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecordsFunc       func(input *dynamodbstreams.GetRecordsInput) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+func (tc TestClient) DescribeStreamWithContext(ctx aws.Context, input *dynamodbstreams.DescribeStreamInput, opts ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error) {
+	return tc.DescribeStreamFunc(input)
+}
+func (tc TestClient) GetShardIteratorWithContext(ctx aws.Context, input *dynamodbstreams.GetShardIteratorInput, opts ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	return tc.GetShardIteratorFunc(input)
+}
+func (tc TestClient) GetRecordsWithContext(ctx aws.Context, input *dynamodbstreams.GetRecordsInput, opts ...request.Option) (*dynamodbstreams.GetRecordsOutput, error) {
+	return tc.GetRecordsFunc(input)
+}
+
+func describeShards(shards ...*dynamodbstreams.Shard) func(input *dynamodbstreams.DescribeStreamInput) (*dynamodbstreams.DescribeStreamOutput, error) {
+	return func(input *dynamodbstreams.DescribeStreamInput) (*dynamodbstreams.DescribeStreamOutput, error) {
+		// Return one shard per page.
+		i := 0
+		if input.ExclusiveStartShardId != nil {
+			for j, s := range shards {
+				if *s.ShardId == *input.ExclusiveStartShardId {
+					i = j + 1
+				}
+			}
+		}
+		sd := &dynamodbstreams.StreamDescription{
+			TableName: aws.String("users"),
+			Shards:    shards[i : i+1],
+		}
+		if i < len(shards)-1 {
+			sd.LastEvaluatedShardId = shards[i].ShardId
+		}
+		return &dynamodbstreams.DescribeStreamOutput{StreamDescription: sd}, nil
+	}
+}
+
+func record(eventName, sequenceNumber, id string) *dynamodbstreams.Record {
+	return &dynamodbstreams.Record{
+		EventID:   aws.String("event_" + sequenceNumber),
+		EventName: aws.String(eventName),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			SequenceNumber: aws.String(sequenceNumber),
+			Keys: map[string]*dynamodb.AttributeValue{
+				"id": {S: aws.String(id)},
+			},
+		},
+	}
+}
+
+func userID(id string) string {
+	return data.NewID("dynamo.users.id", id).String()
+}
+
+func TestGet(t *testing.T) {
+	tests := []struct {
+		name             string
+		shards           []*dynamodbstreams.Shard
+		records          map[string][]*dynamodbstreams.Record
+		from             expiry.StreamPosition
+		expectedKeys     []string
+		expectedTo       expiry.StreamPosition
+		expectedIterator map[string]string
+	}{
+		{
+			name: "inserts, modifications and removals are mapped to data IDs",
+			shards: []*dynamodbstreams.Shard{
+				{ShardId: aws.String("shard_1")},
+				{ShardId: aws.String("shard_2")},
+			},
+			records: map[string][]*dynamodbstreams.Record{
+				"shard_1": {
+					record(dynamodbstreams.OperationTypeInsert, "100", "a"),
+					record(dynamodbstreams.OperationTypeModify, "101", "b"),
+				},
+				"shard_2": {
+					record(dynamodbstreams.OperationTypeRemove, "200", "c"),
+				},
+			},
+			from: expiry.StreamPosition{
+				"shard_1": "99",
+				"shard_2": "199",
+			},
+			expectedKeys: []string{userID("a"), userID("b"), userID("c")},
+			expectedTo: expiry.StreamPosition{
+				"shard_1": "101",
+				"shard_2": "200",
+			},
+			expectedIterator: map[string]string{
+				"shard_1": dynamodbstreams.ShardIteratorTypeAfterSequenceNumber,
+				"shard_2": dynamodbstreams.ShardIteratorTypeAfterSequenceNumber,
+			},
+		},
+		{
+			name: "shards without a position start at the latest record, and keep the iterator",
+			shards: []*dynamodbstreams.Shard{
+				{ShardId: aws.String("shard_1")},
+			},
+			expectedTo: expiry.StreamPosition{"shard_1": iteratorPosition("shard_1/0")},
+			expectedIterator: map[string]string{
+				"shard_1": dynamodbstreams.ShardIteratorTypeLatest,
+			},
+		},
+		{
+			name: "kept iterators are read from",
+			shards: []*dynamodbstreams.Shard{
+				{ShardId: aws.String("shard_1")},
+			},
+			records: map[string][]*dynamodbstreams.Record{
+				"shard_1": {
+					record(dynamodbstreams.OperationTypeInsert, "101", "a"),
+				},
+			},
+			from:             expiry.StreamPosition{"shard_1": iteratorPosition("shard_1/0")},
+			expectedKeys:     []string{userID("a")},
+			expectedTo:       expiry.StreamPosition{"shard_1": "101"},
+			expectedIterator: map[string]string{},
+		},
+		{
+			name: "kept iterators are replaced while there are no records",
+			shards: []*dynamodbstreams.Shard{
+				{ShardId: aws.String("shard_1")},
+			},
+			records: map[string][]*dynamodbstreams.Record{
+				"shard_1": {
+					record(dynamodbstreams.OperationTypeInsert, "101", "a"),
+				},
+			},
+			from:             expiry.StreamPosition{"shard_1": iteratorPosition("shard_1/1")},
+			expectedTo:       expiry.StreamPosition{"shard_1": iteratorPosition("shard_1/1")},
+			expectedIterator: map[string]string{},
+		},
+		{
+			name: "shards with no new records keep their position",
+			shards: []*dynamodbstreams.Shard{
+				{ShardId: aws.String("shard_1")},
+			},
+			from:       expiry.StreamPosition{"shard_1": "100"},
+			expectedTo: expiry.StreamPosition{"shard_1": "100"},
+			expectedIterator: map[string]string{
+				"shard_1": dynamodbstreams.ShardIteratorTypeAfterSequenceNumber,
+			},
+		},
+		{
+			name: "closed shards which have been read to the end are skipped",
+			shards: []*dynamodbstreams.Shard{
+				{
+					ShardId: aws.String("shard_1"),
+					SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{
+						EndingSequenceNumber: aws.String("100"),
+					},
+				},
+				{
+					ShardId: aws.String("shard_2"),
+					SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{
+						EndingSequenceNumber: aws.String("200"),
+					},
+				},
+			},
+			records: map[string][]*dynamodbstreams.Record{
+				"shard_2": {
+					record(dynamodbstreams.OperationTypeInsert, "200", "a"),
+				},
+			},
+			from:         expiry.StreamPosition{"shard_1": "100", "shard_2": "199"},
+			expectedKeys: []string{userID("a")},
+			expectedTo:   expiry.StreamPosition{"shard_1": expiry.ShardEnd, "shard_2": "200"},
+			expectedIterator: map[string]string{
+				"shard_2": dynamodbstreams.ShardIteratorTypeAfterSequenceNumber,
+			},
+		},
+		{
+			name: "child shards are read from their first record once their parent has been read to the end",
+			shards: []*dynamodbstreams.Shard{
+				{
+					ShardId: aws.String("shard_1"),
+					SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{
+						EndingSequenceNumber: aws.String("100"),
+					},
+				},
+				{
+					ShardId:       aws.String("shard_2"),
+					ParentShardId: aws.String("shard_1"),
+				},
+			},
+			records: map[string][]*dynamodbstreams.Record{
+				"shard_2": {
+					record(dynamodbstreams.OperationTypeInsert, "150", "a"),
+				},
+			},
+			from:         expiry.StreamPosition{"shard_1": "100"},
+			expectedKeys: []string{userID("a")},
+			expectedTo:   expiry.StreamPosition{"shard_1": expiry.ShardEnd, "shard_2": "150"},
+			expectedIterator: map[string]string{
+				"shard_2": dynamodbstreams.ShardIteratorTypeTrimHorizon,
+			},
+		},
+		{
+			name: "child shards aren't read until their parent has been read to the end",
+			shards: []*dynamodbstreams.Shard{
+				{
+					ShardId: aws.String("shard_1"),
+					SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{
+						EndingSequenceNumber: aws.String("100"),
+					},
+				},
+				{
+					ShardId:       aws.String("shard_2"),
+					ParentShardId: aws.String("shard_1"),
+				},
+			},
+			records: map[string][]*dynamodbstreams.Record{
+				"shard_1": {
+					record(dynamodbstreams.OperationTypeInsert, "100", "a"),
+				},
+				"shard_2": {
+					record(dynamodbstreams.OperationTypeInsert, "150", "b"),
+				},
+			},
+			from:         expiry.StreamPosition{"shard_1": "99"},
+			expectedKeys: []string{userID("a")},
+			expectedTo:   expiry.StreamPosition{"shard_1": "100"},
+			expectedIterator: map[string]string{
+				"shard_1": dynamodbstreams.ShardIteratorTypeAfterSequenceNumber,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		iterators := map[string]string{}
+		s := Stream{
+			StreamARN: "arn",
+			Mapper:    KeyMapper("dynamo"),
+			Client: TestClient{
+				DescribeStreamFunc: describeShards(test.shards...),
+				GetShardIteratorFunc: func(input *dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error) {
+					iterators[*input.ShardId] = *input.ShardIteratorType
+					return &dynamodbstreams.GetShardIteratorOutput{
+						ShardIterator: aws.String(*input.ShardId + "/0"),
+					}, nil
+				},
+				GetRecordsFunc: func(input *dynamodbstreams.GetRecordsInput) (*dynamodbstreams.GetRecordsOutput, error) {
+					// Return one record per call. Iterators are in the form "shard/index".
+					sep := strings.LastIndex(*input.ShardIterator, "/")
+					shard := (*input.ShardIterator)[:sep]
+					i, _ := strconv.Atoi((*input.ShardIterator)[sep+1:])
+					records := test.records[shard]
+					if i >= len(records) {
+						return &dynamodbstreams.GetRecordsOutput{
+							NextShardIterator: input.ShardIterator,
+						}, nil
+					}
+					return &dynamodbstreams.GetRecordsOutput{
+						Records:           records[i : i+1],
+						NextShardIterator: aws.String(fmt.Sprintf("%s/%d", shard, i+1)),
+					}, nil
+				},
+			},
+		}
+		keys, to, err := s.Get(context.Background(), test.from)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(keys, test.expectedKeys) {
+			t.Errorf("%s: expected keys %v, got %v", test.name, test.expectedKeys, keys)
+		}
+		if !reflect.DeepEqual(to, test.expectedTo) {
+			t.Errorf("%s: expected position %v, got %v", test.name, test.expectedTo, to)
+		}
+		if !reflect.DeepEqual(iterators, test.expectedIterator) {
+			t.Errorf("%s: expected iterators %v, got %v", test.name, test.expectedIterator, iterators)
+		}
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	s := Stream{
+		Mapper: KeyMapper("dynamo"),
+		Client: TestClient{
+			DescribeStreamFunc: func(input *dynamodbstreams.DescribeStreamInput) (*dynamodbstreams.DescribeStreamOutput, error) {
+				return nil, errors.New("network error")
+			},
+		},
+	}
+	if _, _, err := s.Get(context.Background(), expiry.StreamPosition{}); err == nil {
+		t.Errorf("expected an error when the stream can't be described")
+	}
+}
+
+func TestGetReturnsExpiredPositions(t *testing.T) {
+	s := Stream{
+		Mapper: KeyMapper("dynamo"),
+		Client: TestClient{
+			DescribeStreamFunc: describeShards(&dynamodbstreams.Shard{ShardId: aws.String("shard_1")}),
+			GetShardIteratorFunc: func(input *dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error) {
+				return nil, awserr.New(dynamodbstreams.ErrCodeTrimmedDataAccessException, "trimmed", nil)
+			},
+		},
+	}
+	_, _, err := s.Get(context.Background(), expiry.StreamPosition{"shard_1": "100"})
+	expired, ok := err.(*expiry.PositionExpiredError)
+	if !ok {
+		t.Fatalf("expected a *expiry.PositionExpiredError, got %v", err)
+	}
+	if expired.Shard != "shard_1" || expired.Position != "100" {
+		t.Errorf("expected shard_1 at 100 to have expired, got %v at %v", expired.Shard, expired.Position)
+	}
+}
+
+func TestGetReadsShardsFromTheirFirstRecordWhenKeptIteratorsExpire(t *testing.T) {
+	var iteratorType string
+	s := Stream{
+		Mapper: KeyMapper("dynamo"),
+		Client: TestClient{
+			DescribeStreamFunc: describeShards(&dynamodbstreams.Shard{ShardId: aws.String("shard_1")}),
+			GetShardIteratorFunc: func(input *dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error) {
+				iteratorType = *input.ShardIteratorType
+				return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String("new")}, nil
+			},
+			GetRecordsFunc: func(input *dynamodbstreams.GetRecordsInput) (*dynamodbstreams.GetRecordsOutput, error) {
+				if *input.ShardIterator == "old" {
+					return nil, awserr.New(dynamodbstreams.ErrCodeExpiredIteratorException, "expired", nil)
+				}
+				// The shard has been closed since the iterator was kept.
+				return &dynamodbstreams.GetRecordsOutput{
+					Records: []*dynamodbstreams.Record{record(dynamodbstreams.OperationTypeModify, "101", "a")},
+				}, nil
+			},
+		},
+	}
+
+	keys, to, err := s.Get(context.Background(), expiry.StreamPosition{"shard_1": iteratorPosition("old")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if iteratorType != dynamodbstreams.ShardIteratorTypeTrimHorizon {
+		t.Errorf("expected the shard to be read from its first record, got %v", iteratorType)
+	}
+	if expected := []string{userID("a")}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+	if expected := (expiry.StreamPosition{"shard_1": expiry.ShardEnd}); !reflect.DeepEqual(to, expected) {
+		t.Errorf("expected position %v, got %v", expected, to)
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	iterators := map[string]string{}
+	s := Stream{
+		Mapper: KeyMapper("dynamo"),
+		Client: TestClient{
+			DescribeStreamFunc: describeShards(
+				&dynamodbstreams.Shard{
+					ShardId: aws.String("shard_1"),
+					SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{
+						EndingSequenceNumber: aws.String("100"),
+					},
+				},
+				&dynamodbstreams.Shard{ShardId: aws.String("shard_2")},
+			),
+			GetShardIteratorFunc: func(input *dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error) {
+				iterators[*input.ShardId] = *input.ShardIteratorType
+				return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: aws.String(*input.ShardId + "/latest")}, nil
+			},
+		},
+	}
+
+	pos, err := s.Anchor(context.Background(), time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := (expiry.StreamPosition{"shard_2": iteratorPosition("shard_2/latest")}); !reflect.DeepEqual(pos, expected) {
+		t.Errorf("expected position %v, got %v", expected, pos)
+	}
+	if expected := (map[string]string{"shard_2": dynamodbstreams.ShardIteratorTypeLatest}); !reflect.DeepEqual(iterators, expected) {
+		t.Errorf("expected iterators %v, got %v", expected, iterators)
+	}
+}
+
+func TestGetReturnsTheChangesReadBeforeTheContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var requests int
+	s := Stream{
+		Mapper: KeyMapper("dynamo"),
+		Client: TestClient{
+			DescribeStreamFunc: describeShards(
+				&dynamodbstreams.Shard{ShardId: aws.String("shard_1")},
+				&dynamodbstreams.Shard{ShardId: aws.String("shard_2")},
+			),
+			GetShardIteratorFunc: func(input *dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error) {
+				return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: input.ShardId}, nil
+			},
+			GetRecordsFunc: func(input *dynamodbstreams.GetRecordsInput) (*dynamodbstreams.GetRecordsOutput, error) {
+				requests++
+				if requests > 1 {
+					// The request is cancelled while waiting for the second page.
+					cancel()
+					return nil, errors.New("RequestCanceled")
+				}
+				return &dynamodbstreams.GetRecordsOutput{
+					Records:           []*dynamodbstreams.Record{record(dynamodbstreams.OperationTypeModify, "101", "a")},
+					NextShardIterator: input.ShardIterator,
+				}, nil
+			},
+		},
+	}
+
+	keys, to, err := s.Get(ctx, expiry.StreamPosition{"shard_1": "100", "shard_2": "200"})
+	if err != context.Canceled {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+	if expected := []string{userID("a")}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+	if expected := (expiry.StreamPosition{"shard_1": "101", "shard_2": "200"}); !reflect.DeepEqual(to, expected) {
+		t.Errorf("expected position %v, got %v", expected, to)
+	}
+}
+
+func TestKeyMapper(t *testing.T) {
+	tests := []struct {
+		name        string
+		keys        map[string]*dynamodb.AttributeValue
+		expected    []data.ID
+		expectedErr error
+	}{
+		{
+			name: "string hash key",
+			keys: map[string]*dynamodb.AttributeValue{
+				"id": {S: aws.String("123")},
+			},
+			expected: []data.ID{data.NewID("dynamo.users.id", "123")},
+		},
+		{
+			name: "composite key",
+			keys: map[string]*dynamodb.AttributeValue{
+				"line": {N: aws.String("1")},
+				"id":   {S: aws.String("123")},
+			},
+			expected: []data.ID{data.NewID("dynamo.users.id.line", "123/1")},
+		},
+		{
+			name: "binary key",
+			keys: map[string]*dynamodb.AttributeValue{
+				"id": {B: []byte("abc")},
+			},
+			expected: []data.ID{data.NewID("dynamo.users.id", "YWJj")},
+		},
+		{
+			name: "unsupported key",
+			keys: map[string]*dynamodb.AttributeValue{
+				"id": {BOOL: aws.Bool(true)},
+			},
+			expectedErr: ErrUnsupportedKeyType,
+		},
+	}
+
+	for _, test := range tests {
+		ids, err := KeyMapper("dynamo")("users", test.keys)
+		if err != test.expectedErr {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expectedErr, err)
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, ids)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package scache
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/a-h/scache/adaptive"
+	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/changes"
+	"github.com/a-h/scache/data"
+	"github.com/a-h/scache/expiry"
+)
+
+// Stream shares invalidations between instances, e.g. expiry.Stream, or memory.Stream.
+type Stream interface {
+	changes.StreamGetter
+	changes.StreamPutter
+}
+
+// NewEngine creates an Engine which caches items for between the min and max durations, and uses the
+// stream to share invalidations with other instances.
+func NewEngine(s Stream, minCacheDuration, maxCacheDuration time.Duration) *Engine {
+	c := cache.New()
+	c.Expiration = cache.ExpireBetween(minCacheDuration, maxCacheDuration)
+	o := changes.NewObserver(s)
+	return &Engine{
+		Observer: o,
+		Cache:    c,
+		// The Engine removes data from its own cache when it's invalidated, so its Observer can skip the
+		// invalidations written by its Notifier.
+		Notifier: changes.NewNotifierFor(s, o),
+	}
+}
+
+// Engine owns the cache, and the observer and notifier used to keep it up-to-date. A single Engine can
+// be shared by any number of HTTP middleware, gRPC interceptors and Lambda handlers, so that they share
+// cache entries, and the stream is only read once per request.
+type Engine struct {
+	Observer *changes.Observer
+	Notifier changes.Notifier
+	Cache    *cache.Cache
+	// Consistency defines what happens when the stream can't be read, defaults to FailOpen.
+	Consistency Consistency
+	// MaxStaleness is the maximum age of the last successful read of the stream before the cache
+	// is bypassed when using BoundedStaleness.
+	MaxStaleness time.Duration
+	// ObserveTimeout limits the time spent reading the stream at the start of each session, in addition to
+	// the deadline of the session's context. If reading stops early, the invalidations read so far are
+	// applied, and the next session continues reading from where it stopped. Until it has caught up, the
+	// cache is treated as if the stream couldn't be read. If zero, there's no limit.
+	ObserveTimeout time.Duration
+	// OnFlushError is called when invalidations can't be sent to the stream.
+	OnFlushError FlushErrorHandler
+	// ServerTiming adds a Server-Timing header to each HTTP response, showing where time was spent, how much
+	// time the cache saved, and the number of cache hits and misses.
+	ServerTiming bool
+	// Controller disables caching when it costs more time than it saves, and re-enables it periodically
+	// to check again. If nil, caching is always enabled.
+	Controller *adaptive.Controller
+	// TTLPolicy chooses how long to cache data from each source, based on how often it's invalidated
+	// and how long it takes to load. If nil, the cache's Expiration function is used.
+	TTLPolicy *adaptive.TTLPolicy
+
+	mutex        sync.Mutex
+	lastObserved time.Time
+	failing      bool
+	// positionExpiries is the number of times the position in the stream has expired.
+	positionExpiries int64
+	// backlogsSkipped is the number of times the backlog of the stream was too large to read.
+	backlogsSkipped int64
+}
+
+// PositionExpiries returns the number of times that the Engine's position in the stream has expired, e.g.
+// after being idle for longer than the stream's retention period, causing the cache to be flushed.
+func (e *Engine) PositionExpiries() int64 {
+	return atomic.LoadInt64(&e.positionExpiries)
+}
+
+// BacklogsSkipped returns the number of times that the backlog of the stream was too large to read, causing
+// the cache to be flushed, and the position to move to the tip of the stream.
+func (e *Engine) BacklogsSkipped() int64 {
+	return atomic.LoadInt64(&e.backlogsSkipped)
+}
+
+// Middleware creates HTTP middleware which adds the Engine's cache to the context of each request. It can
+// be called many times, e.g. to wrap multiple routers.
+func (e *Engine) Middleware(next http.Handler) *Middleware {
+	return &Middleware{
+		Engine: e,
+		Next:   next,
+	}
+}
+
+// Begin brings the cache up-to-date by removing expired and invalidated items, and adds a session to
+// the returned context. The session should be ended once the work is complete. If the context already
+// contains a session started by the Engine, it's reused, so the stream is read at most once per request.
+func (e *Engine) Begin(ctx context.Context) (context.Context, *Session) {
+	if s, ok := FromContext(ctx); ok && s.engine == e {
+		// An outer middleware or interceptor has already started a session, so the cache is up-to-date.
+		// The session is ended when the outermost caller ends it.
+		atomic.AddInt32(&s.refs, 1)
+		return ctx, s
+	}
+	s := &Session{
+		engine:       e,
+		refs:         1,
+		cache:        e.Cache,
+		notifier:     e.Notifier,
+		onFlushError: e.OnFlushError,
+		controller:   e.Controller,
+		ttlPolicy:    e.TTLPolicy,
+		start:        time.Now(),
+	}
+
+	if !e.cachingEnabled() {
+		// Caching costs more than it saves, so don't read the stream. The cache isn't being kept up-to-date,
+		// so it's emptied and bypassed.
+		e.Cache.RemoveAll()
+		s.consistency = ConsistencyState{Consistency: e.Consistency, Bypassed: true, Disabled: true}
+		s.handlerStart = time.Now()
+		return context.WithValue(ctx, cacheContextKey, s), s
+	}
+
+	e.Cache.RemoveExpired()
+	expired := time.Now()
+	s.timings.expire = int64(expired.Sub(s.start))
+
+	s.deadline, s.hasDeadline = ctx.Deadline()
+	s.consistency = e.observe(ctx)
+	s.handlerStart = time.Now()
+	s.timings.observe = int64(s.handlerStart.Sub(expired))
+	if s.consistency.BacklogSkipped {
+		s.timings.backlogSkipped = 1
+	}
+
+	if e.Controller != nil {
+		e.Controller.RecordCost(s.handlerStart.Sub(s.start))
+	}
+
+	return context.WithValue(ctx, cacheContextKey, s), s
+}
+
+// cachingEnabled checks with the Controller whether caching is worthwhile, logging any change.
+func (e *Engine) cachingEnabled() bool {
+	if e.Controller == nil {
+		return true
+	}
+	d, changed := e.Controller.Check()
+	if changed {
+		logger.
+			WithField("enabled", d.Enabled).
+			WithField("reason", d.Reason).
+			WithField("cost", d.Cost).
+			WithField("saved", d.Saved).
+			Info("adaptive caching decision")
+	}
+	return d.Enabled
+}
+
+// observe removes invalidated items from the cache, and applies the consistency policy.
+func (e *Engine) observe(ctx context.Context) (s ConsistencyState) {
+	s.Consistency = e.Consistency
+	if e.ObserveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.ObserveTimeout)
+		defer cancel()
+	}
+
+	e.mutex.Lock()
+	failing := e.failing
+	e.mutex.Unlock()
+
+	var err error
+	if e.Cache.Count() == 0 && !failing {
+		// There's a chance that something could have snuck into the cache between
+		// removing expired records, and reading the count, which means that sometimes
+		// we might update from the stream when we didn't really need to, but that's
+		// better than having a global lock.
+		err = e.Observer.Reset(ctx)
+	} else {
+		if failing {
+			// The cache was flushed when the failure happened, so there's nothing to catch up on.
+			err = e.Observer.Reset(ctx)
+		}
+		if err == nil {
+			var toRemove []data.ID
+			toRemove, err = e.Observer.Observe(ctx)
+			// Invalidations may have been missed. The Observer has moved to the current position, so once the
+			// cache is empty, it's consistent again.
+			switch skipped := err.(type) {
+			case *expiry.PositionExpiredError:
+				e.Cache.RemoveAll()
+				atomic.AddInt64(&e.positionExpiries, 1)
+				logger.
+					WithError(skipped).
+					WithField("shard", skipped.Shard).
+					WithField("position", skipped.Position).
+					Warn("stream position expired, cache flushed")
+				s.PositionExpired = true
+				err = nil
+			case *expiry.BacklogExceededError:
+				e.Cache.RemoveAll()
+				atomic.AddInt64(&e.backlogsSkipped, 1)
+				logger.
+					WithError(skipped).
+					WithField("reason", skipped.Reason).
+					WithField("records", skipped.Records).
+					WithField("bytes", skipped.Bytes).
+					WithField("behind", skipped.Behind).
+					Warn("stream backlog skipped, cache flushed")
+				s.BacklogSkipped = true
+				err = nil
+			}
+			for _, tr := range toRemove {
+				e.Cache.Remove(tr.String())
+				if e.TTLPolicy != nil {
+					e.TTLPolicy.RecordInvalidation(tr.Source)
+				}
+			}
+		}
+	}
+
+	// If reading stopped because the context was done, the Observer kept its position, so the next session
+	// catches up without flushing the cache.
+	stopped := err != nil && ctx.Err() != nil
+
+	now := time.Now()
+	e.mutex.Lock()
+	if err == nil {
+		e.lastObserved = now
+	}
+	e.failing = err != nil && !stopped && e.Consistency == FailClosed
+	s.LastObserved = e.lastObserved
+	e.mutex.Unlock()
+
+	if stopped {
+		logger.WithError(err).WithField("consistency", e.Consistency.String()).Warn("stopped observing stream, continuing next session")
+		s.Err = err
+	} else if err != nil {
+		logger.WithError(err).WithField("consistency", e.Consistency.String()).Error("error observing stream")
+		s.Err = err
+	}
+	switch e.Consistency {
+	case FailClosed:
+		if err != nil {
+			if !stopped {
+				e.Cache.RemoveAll()
+			}
+			s.Bypassed = true
+		}
+	case BoundedStaleness:
+		s.Bypassed = now.Sub(s.LastObserved) > e.MaxStaleness
+	}
+	return
+}
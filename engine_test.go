@@ -0,0 +1,164 @@
+package scache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/changes"
+	"github.com/a-h/scache/data"
+	"github.com/a-h/scache/expiry"
+)
+
+func TestNestedMiddlewareObservesOncePerRequest(t *testing.T) {
+	// Arrange.
+	var observed int
+	engine := &Engine{
+		Observer: changes.NewObserver(testStreamGetter{
+			GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+				observed++
+				return
+			},
+		}),
+		Cache:        cache.New(),
+		ServerTiming: true,
+	}
+	engine.Cache.Put(data.NewID("db.table.id", "1").String(), "value")
+	var puts int
+	engine.Notifier = changes.NewNotifier(testStreamPutter{
+		PutFunc: func(keys []string) error {
+			puts++
+			return nil
+		},
+	})
+	var outerSession, innerSession *Session
+	inner := engine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		innerSession, _ = FromContext(r.Context())
+		Invalidate(r, data.NewID("db.table.id", "1"))
+	}))
+	outer := engine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outerSession, _ = FromContext(r.Context())
+		inner.ServeHTTP(w, r)
+		if puts != 0 {
+			t.Errorf("expected invalidations to be sent when the outer middleware completes, but %d were sent", puts)
+		}
+	}))
+
+	// Act.
+	w := httptest.NewRecorder()
+	outer.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	// Assert.
+	if observed != 1 {
+		t.Errorf("expected the stream to be read once, but it was read %d times", observed)
+	}
+	if outerSession == nil || outerSession != innerSession {
+		t.Errorf("expected the inner middleware to reuse the outer session")
+	}
+	if puts != 1 {
+		t.Errorf("expected the invalidations to be sent once, but %d were sent", puts)
+	}
+	if headers := w.Header()["Server-Timing"]; len(headers) != 1 {
+		t.Errorf("expected a single Server-Timing header, got %v", headers)
+	}
+}
+
+func TestEnginesShareTheirCacheBetweenMounts(t *testing.T) {
+	engine := &Engine{
+		Observer: changes.NewObserver(testStreamGetter{GetFunc: emptyGet}),
+		Cache:    cache.New(),
+	}
+	id := data.NewID("db.table.id", "1")
+	a := engine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Add(r, id, "value")
+	}))
+	var v string
+	var ok bool
+	b := engine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok = Get(r, id, &v)
+	}))
+
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/a", nil))
+	b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/b", nil))
+
+	if !ok || v != "value" {
+		t.Errorf("expected the value added by one mount to be available to the other, got %q", v)
+	}
+}
+
+func TestSessionsFromDifferentEnginesAreNotShared(t *testing.T) {
+	e1 := &Engine{Observer: changes.NewObserver(testStreamGetter{GetFunc: emptyGet}), Cache: cache.New()}
+	e2 := &Engine{Observer: changes.NewObserver(testStreamGetter{GetFunc: emptyGet}), Cache: cache.New()}
+	ctx, s1 := e1.Begin(context.Background())
+	defer s1.End()
+	_, s2 := e2.Begin(ctx)
+	defer s2.End()
+	if s1 == s2 {
+		t.Errorf("expected each engine to have its own session")
+	}
+}
+
+type contextStreamGetter func(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error)
+
+func (f contextStreamGetter) Get(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	return f(ctx, from)
+}
+
+func TestObservationContinuesWhereItStoppedWhenTheTimeoutIsReached(t *testing.T) {
+	// Arrange.
+	invalidated := data.NewID("db.table.id", "invalidated")
+	valid := data.NewID("db.table.id", "valid")
+	partial := expiry.StreamPosition{"shard_1": "2"}
+	var calls int
+	engine := &Engine{
+		Observer: changes.NewObserver(contextStreamGetter(func(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+			calls++
+			if calls == 1 {
+				// The stream is slow, so only some of it is read before the timeout.
+				<-ctx.Done()
+				return []string{invalidated.String()}, partial, ctx.Err()
+			}
+			if !reflect.DeepEqual(from, partial) {
+				t.Errorf("expected to continue from %v, got %v", partial, from)
+			}
+			return nil, from, nil
+		})),
+		Cache:          cache.New(),
+		Consistency:    FailClosed,
+		ObserveTimeout: time.Millisecond * 10,
+	}
+	engine.Cache.Put(invalidated.String(), "invalidated")
+	engine.Cache.Put(valid.String(), "valid")
+
+	// Act.
+	_, s := engine.Begin(context.Background())
+	s.End()
+
+	// Assert.
+	state := s.Consistency()
+	if state.Err == nil || !state.Bypassed {
+		t.Errorf("expected the cache to be bypassed until the stream has been read, got %+v", state)
+	}
+	if _, ok := engine.Cache.Get(invalidated.String()); ok {
+		t.Error("expected the invalidations read before the timeout to be applied")
+	}
+	if _, ok := engine.Cache.Get(valid.String()); !ok {
+		t.Error("expected the cache not to be flushed")
+	}
+
+	// Act: the next session catches up.
+	_, s = engine.Begin(context.Background())
+	s.End()
+
+	// Assert.
+	if state := s.Consistency(); state.Err != nil || state.Bypassed {
+		t.Errorf("expected the cache to be used once the stream has been read, got %+v", state)
+	}
+	if calls != 2 {
+		t.Errorf("expected the stream to be read twice, got %d", calls)
+	}
+}
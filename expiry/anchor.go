@@ -0,0 +1,66 @@
+package expiry
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// atTimestampPrefix marks a position which reads the records added to a shard since a point in time.
+const atTimestampPrefix = "AT_TIMESTAMP:"
+
+// anchorMargin is subtracted from the time passed to Anchor, since Kinesis records the time that a record
+// arrived using its own clock. Reading records twice is harmless.
+const anchorMargin = time.Second * 5
+
+// AtTimestamp returns a position within a shard which reads the records added since t.
+func AtTimestamp(t time.Time) SequenceNumber {
+	return SequenceNumber(atTimestampPrefix + t.UTC().Format(time.RFC3339Nano))
+}
+
+// timestamp returns the time of a position created by AtTimestamp.
+func (sn SequenceNumber) timestamp() (t time.Time, ok bool) {
+	if !strings.HasPrefix(string(sn), atTimestampPrefix) {
+		return
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(string(sn), atTimestampPrefix))
+	return t, err == nil
+}
+
+// Anchor returns a position for each open shard, which reads the records added since at. Unlike an empty
+// position, which starts reading from the latest record when Get is next called, no records added between
+// at and the next call to Get are missed.
+func (p Stream) Anchor(ctx context.Context, at time.Time) (pos StreamPosition, err error) {
+	shards, err := p.cachedShards(ctx)
+	if err != nil {
+		err = fmt.Errorf("Anchor: failed to list all shards: %v", err)
+		return
+	}
+	pos = StreamPosition{}
+	sn := AtTimestamp(at.Add(-anchorMargin))
+	for _, s := range shards {
+		if s.SequenceNumberRange != nil && s.SequenceNumberRange.EndingSequenceNumber != nil {
+			continue
+		}
+		pos[ShardID(*s.ShardId)] = sn
+	}
+	return
+}
+
+// PositionExpiredError is returned by Get when a position can no longer be read from, because the records
+// after it have been removed from the stream, e.g. when the reader has been idle for longer than the
+// stream's retention period. Changes may have been missed, so the cache should be flushed, and the position
+// anchored again.
+type PositionExpiredError struct {
+	// Shard whose position has expired.
+	Shard ShardID
+	// Position which has expired.
+	Position SequenceNumber
+	// Err is the error returned by the stream.
+	Err error
+}
+
+func (e *PositionExpiredError) Error() string {
+	return fmt.Sprintf("position '%v' of shard '%v' has expired: %v", e.Position, e.Shard, e.Err)
+}
@@ -0,0 +1,113 @@
+package expiry
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestAtTimestamp(t *testing.T) {
+	at := time.Date(2018, time.June, 11, 14, 0, 0, 123, time.UTC)
+	actual, ok := AtTimestamp(at).timestamp()
+	if !ok || !actual.Equal(at) {
+		t.Errorf("expected %v, got %v", at, actual)
+	}
+	if _, ok := SequenceNumber("49585").timestamp(); ok {
+		t.Error("expected sequence numbers not to be timestamps")
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	at := time.Date(2018, time.June, 11, 14, 0, 0, 0, time.UTC)
+	s := NewStream("test")
+	s.limiter = nil
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{closedShard("parent"), openShard("child_1", "parent"), openShard("child_2", "parent")}}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			if *input.ShardIteratorType != kinesis.ShardIteratorTypeAtTimestamp {
+				t.Errorf("expected an AT_TIMESTAMP iterator, got %v", *input.ShardIteratorType)
+			}
+			if expected := at.Add(-anchorMargin); input.Timestamp == nil || !input.Timestamp.Equal(expected) {
+				t.Errorf("expected a timestamp of %v, got %v", expected, input.Timestamp)
+			}
+			return &kinesis.GetShardIteratorOutput{ShardIterator: input.ShardId}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			if *input.ShardIterator == "child_1" {
+				return &kinesis.GetRecordsOutput{
+					Records: []*kinesis.Record{{SequenceNumber: aws.String("1"), Data: []byte(`{ "keys": ["a"] }`)}},
+				}, nil
+			}
+			return &kinesis.GetRecordsOutput{}, nil
+		},
+	}
+
+	pos, err := s.Anchor(context.Background(), at)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	anchor := AtTimestamp(at.Add(-anchorMargin))
+	if expected := (StreamPosition{"child_1": anchor, "child_2": anchor}); !reflect.DeepEqual(pos, expected) {
+		t.Errorf("expected the open shards to be anchored at %v, got %v", expected, pos)
+	}
+
+	keys, to, err := s.Get(context.Background(), pos)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("expected the records added since the anchor to be read, got %v", keys)
+	}
+	if expected := (StreamPosition{"child_1": "1", "child_2": anchor}); !reflect.DeepEqual(to, expected) {
+		t.Errorf("expected shards without new records to keep the anchor, got %v", to)
+	}
+}
+
+func TestGetReturnsExpiredPositions(t *testing.T) {
+	tests := []struct {
+		name          string
+		from          StreamPosition
+		expectExpired bool
+	}{
+		{
+			name:          "invalid sequence numbers have expired",
+			from:          StreamPosition{"shard_1": "1"},
+			expectExpired: true,
+		},
+		{
+			name:          "other invalid arguments are errors",
+			from:          StreamPosition{},
+			expectExpired: false,
+		},
+	}
+
+	for _, test := range tests {
+		s := NewStream("test")
+		s.svc = TestKinesisStream{
+			ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+				return &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{openShard("shard_1")}}, nil
+			},
+			GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+				return nil, awserr.New(kinesis.ErrCodeInvalidArgumentException, "invalid", nil)
+			},
+		}
+		_, _, err := s.Get(context.Background(), test.from)
+		if err == nil {
+			t.Fatalf("%s: expected an error", test.name)
+		}
+		expired, isExpired := err.(*PositionExpiredError)
+		if isExpired != test.expectExpired {
+			t.Errorf("%s: expected expired %v, got %v", test.name, test.expectExpired, err)
+		}
+		if isExpired && (expired.Shard != "shard_1" || expired.Position != "1") {
+			t.Errorf("%s: expected shard_1 at 1 to have expired, got %v at %v", test.name, expired.Shard, expired.Position)
+		}
+	}
+}
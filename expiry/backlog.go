@@ -0,0 +1,86 @@
+package expiry
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// BacklogLimit is the largest backlog of records that Get reads before giving up. When a reader has been
+// idle for a long time, flushing the cache and starting again from the tip of the stream is cheaper than
+// reading every record. Zero values aren't limited.
+type BacklogLimit struct {
+	// Records is the maximum number of records read.
+	Records int64
+	// Bytes is the maximum size of the records read.
+	Bytes int64
+	// Behind is the maximum time that a shard can be behind its tip, as reported by Kinesis.
+	Behind time.Duration
+	// Duration is the maximum time spent reading the stream.
+	Duration time.Duration
+}
+
+// BacklogExceededError is returned by Get when the backlog of records exceeds the stream's BacklogLimit.
+// Records which haven't been read may contain invalidations, so the cache should be flushed, and the
+// position anchored again.
+type BacklogExceededError struct {
+	// Reason is the limit which was exceeded.
+	Reason string
+	// Records and Bytes read before the limit was exceeded.
+	Records, Bytes int64
+	// Behind is how far behind the tip of the shard the last read was.
+	Behind time.Duration
+	// Elapsed is the time spent reading the stream.
+	Elapsed time.Duration
+}
+
+func (e *BacklogExceededError) Error() string {
+	return fmt.Sprintf("Get: backlog exceeded the %s limit after reading %d records (%d bytes) in %v, %v behind", e.Reason, e.Records, e.Bytes, e.Elapsed, e.Behind)
+}
+
+// backlog tracks the records read by a single Get, across all shards.
+type backlog struct {
+	limit   BacklogLimit
+	start   time.Time
+	now     func() time.Time
+	records int64
+	bytes   int64
+}
+
+func newBacklog(limit BacklogLimit) *backlog {
+	return &backlog{
+		limit: limit,
+		start: time.Now(),
+		now:   time.Now,
+	}
+}
+
+// add records a batch of records, and returns a *BacklogExceededError if a limit has been exceeded.
+func (b *backlog) add(records, bytes int64, behind time.Duration) error {
+	if b == nil {
+		return nil
+	}
+	r := atomic.AddInt64(&b.records, records)
+	s := atomic.AddInt64(&b.bytes, bytes)
+	elapsed := b.now().Sub(b.start)
+	var reason string
+	switch {
+	case b.limit.Records > 0 && r > b.limit.Records:
+		reason = "records"
+	case b.limit.Bytes > 0 && s > b.limit.Bytes:
+		reason = "bytes"
+	case b.limit.Behind > 0 && behind > b.limit.Behind:
+		reason = "behind"
+	case b.limit.Duration > 0 && elapsed > b.limit.Duration:
+		reason = "duration"
+	default:
+		return nil
+	}
+	return &BacklogExceededError{
+		Reason:  reason,
+		Records: r,
+		Bytes:   s,
+		Behind:  behind,
+		Elapsed: elapsed,
+	}
+}
@@ -0,0 +1,111 @@
+package expiry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestBacklog(t *testing.T) {
+	tests := []struct {
+		name           string
+		limit          BacklogLimit
+		records, bytes int64
+		behind         time.Duration
+		elapsed        time.Duration
+		expectedReason string
+	}{
+		{
+			name:    "no limit",
+			records: 1000000,
+			bytes:   1000000,
+			behind:  time.Hour,
+			elapsed: time.Hour,
+		},
+		{
+			name:    "within the limits",
+			limit:   BacklogLimit{Records: 10, Bytes: 100, Behind: time.Minute, Duration: time.Second},
+			records: 10,
+			bytes:   100,
+			behind:  time.Minute,
+			elapsed: time.Second,
+		},
+		{
+			name:           "too many records",
+			limit:          BacklogLimit{Records: 10},
+			records:        11,
+			expectedReason: "records",
+		},
+		{
+			name:           "too many bytes",
+			limit:          BacklogLimit{Bytes: 100},
+			bytes:          101,
+			expectedReason: "bytes",
+		},
+		{
+			name:           "too far behind",
+			limit:          BacklogLimit{Behind: time.Minute},
+			behind:         time.Minute * 2,
+			expectedReason: "behind",
+		},
+		{
+			name:           "too slow",
+			limit:          BacklogLimit{Duration: time.Second},
+			elapsed:        time.Second * 2,
+			expectedReason: "duration",
+		},
+	}
+
+	for _, test := range tests {
+		b := newBacklog(test.limit)
+		b.now = func() time.Time { return b.start.Add(test.elapsed) }
+		err := b.add(test.records, test.bytes, test.behind)
+		if test.expectedReason == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		exceeded, ok := err.(*BacklogExceededError)
+		if !ok {
+			t.Errorf("%s: expected a *BacklogExceededError, got %v", test.name, err)
+			continue
+		}
+		if exceeded.Reason != test.expectedReason {
+			t.Errorf("%s: expected reason '%v', got '%v'", test.name, test.expectedReason, exceeded.Reason)
+		}
+	}
+}
+
+func TestGetStopsWhenTheBacklogIsExceeded(t *testing.T) {
+	var requests int
+	s := NewStream("test")
+	s.limiter = nil
+	s.Backlog = BacklogLimit{Records: 2}
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{openShard("shard_1")}}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			requests++
+			return &kinesis.GetRecordsOutput{
+				Records:            []*kinesis.Record{{SequenceNumber: aws.String("1"), Data: []byte(`{ "keys": ["a"] }`)}},
+				NextShardIterator:  aws.String("iterator"),
+				MillisBehindLatest: aws.Int64(3600000),
+			}, nil
+		},
+	}
+	_, _, err := s.Get(context.Background(), StreamPosition{"shard_1": "0"})
+	if _, ok := err.(*BacklogExceededError); !ok {
+		t.Fatalf("expected a *BacklogExceededError, got %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("expected reading to stop once the limit was exceeded, but %d requests were made", requests)
+	}
+}
@@ -0,0 +1,117 @@
+package expiry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// defaultShardListTTL is how long the list of shards is reused for. New shards created by resharding are
+// read once the list expires.
+const defaultShardListTTL = time.Second * 30
+
+// iteratorTTL is how long a shard iterator is reused for. Kinesis iterators expire after 5 minutes.
+const iteratorTTL = time.Minute * 4
+
+// shardListCache holds the list of shards, so that it isn't requested on every Get.
+type shardListCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	shards  []*kinesis.Shard
+	expires time.Time
+}
+
+func newShardListCache(ttl time.Duration) *shardListCache {
+	return &shardListCache{
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+func (c *shardListCache) get() (shards []*kinesis.Shard, ok bool) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.shards == nil || !c.now().Before(c.expires) {
+		return
+	}
+	return c.shards, true
+}
+
+func (c *shardListCache) set(shards []*kinesis.Shard) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.shards = shards
+	c.expires = c.now().Add(c.ttl)
+}
+
+// invalidate causes the list of shards to be requested again, e.g. when a shard has been read to the end,
+// since the stream has been resharded.
+func (c *shardListCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.shards = nil
+}
+
+type cachedIterator struct {
+	// from is the position the iterator reads after.
+	from     SequenceNumber
+	iterator string
+	expires  time.Time
+}
+
+// iteratorCache holds the next iterator of each shard, so that the next Get doesn't need to request a new
+// one. Iterators are only reused if they read from the position passed to Get, so the StreamPosition remains
+// the source of truth.
+type iteratorCache struct {
+	mutex     sync.Mutex
+	now       func() time.Time
+	iterators map[ShardID]cachedIterator
+}
+
+func newIteratorCache() *iteratorCache {
+	return &iteratorCache{
+		now:       time.Now,
+		iterators: make(map[ShardID]cachedIterator),
+	}
+}
+
+func (c *iteratorCache) get(shard ShardID, from SequenceNumber) (iterator string, ok bool) {
+	if c == nil || from == "" {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ci, ok := c.iterators[shard]
+	if !ok || ci.from != from || !c.now().Before(ci.expires) {
+		return "", false
+	}
+	return ci.iterator, true
+}
+
+func (c *iteratorCache) set(shard ShardID, from SequenceNumber, iterator *string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if from == "" || iterator == nil {
+		delete(c.iterators, shard)
+		return
+	}
+	c.iterators[shard] = cachedIterator{
+		from:     from,
+		iterator: *iterator,
+		expires:  c.now().Add(iteratorTTL),
+	}
+}
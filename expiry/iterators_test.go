@@ -0,0 +1,154 @@
+package expiry
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestShardListCache(t *testing.T) {
+	now := time.Date(2018, time.June, 11, 14, 0, 0, 0, time.UTC)
+	c := newShardListCache(time.Second * 30)
+	c.now = func() time.Time { return now }
+	if _, ok := c.get(); ok {
+		t.Error("expected an empty cache to miss")
+	}
+	shards := []*kinesis.Shard{openShard("shard_1")}
+	c.set(shards)
+	if actual, ok := c.get(); !ok || !reflect.DeepEqual(actual, shards) {
+		t.Errorf("expected the shards to be cached, got %v", actual)
+	}
+	now = now.Add(time.Second * 30)
+	if _, ok := c.get(); ok {
+		t.Error("expected the list to expire")
+	}
+	c.set(shards)
+	c.invalidate()
+	if _, ok := c.get(); ok {
+		t.Error("expected the list to be invalidated")
+	}
+}
+
+func TestIteratorCache(t *testing.T) {
+	now := time.Date(2018, time.June, 11, 14, 0, 0, 0, time.UTC)
+	c := newIteratorCache()
+	c.now = func() time.Time { return now }
+	c.set("shard_1", "1", aws.String("iterator_1"))
+	tests := []struct {
+		name     string
+		shard    ShardID
+		from     SequenceNumber
+		expected bool
+	}{
+		{
+			name:     "same position",
+			shard:    "shard_1",
+			from:     "1",
+			expected: true,
+		},
+		{
+			name:     "different position",
+			shard:    "shard_1",
+			from:     "0",
+			expected: false,
+		},
+		{
+			name:     "no position",
+			shard:    "shard_1",
+			from:     "",
+			expected: false,
+		},
+		{
+			name:     "different shard",
+			shard:    "shard_2",
+			from:     "1",
+			expected: false,
+		},
+	}
+	for _, test := range tests {
+		if _, ok := c.get(test.shard, test.from); ok != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, ok)
+		}
+	}
+	now = now.Add(iteratorTTL)
+	if _, ok := c.get("shard_1", "1"); ok {
+		t.Error("expected the iterator to expire")
+	}
+	c.set("shard_1", "1", aws.String("iterator_1"))
+	c.set("shard_1", "", nil)
+	if _, ok := c.get("shard_1", "1"); ok {
+		t.Error("expected the iterator to be removed")
+	}
+}
+
+func TestGetReusesShardListAndIterators(t *testing.T) {
+	var listShards, getShardIterator int
+	expired := map[string]bool{}
+	s := NewStream("test")
+	s.limiter = nil
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			listShards++
+			return &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{openShard("shard_1")}}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			getShardIterator++
+			if *input.ShardIteratorType != kinesis.ShardIteratorTypeAfterSequenceNumber {
+				t.Errorf("expected iterators to read after the position, got %v", *input.ShardIteratorType)
+			}
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("after_" + *input.StartingSequenceNumber)}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			if expired[*input.ShardIterator] {
+				delete(expired, *input.ShardIterator)
+				return nil, awserr.New(kinesis.ErrCodeExpiredIteratorException, "expired", nil)
+			}
+			if *input.ShardIterator == "after_1" {
+				return &kinesis.GetRecordsOutput{
+					Records:           []*kinesis.Record{{SequenceNumber: aws.String("2"), Data: []byte(`{ "keys": ["key_2"] }`)}},
+					NextShardIterator: aws.String("after_2"),
+				}, nil
+			}
+			return &kinesis.GetRecordsOutput{NextShardIterator: input.ShardIterator}, nil
+		},
+	}
+
+	// The first read requests the shard list and an iterator.
+	keys, to, err := s.Get(context.Background(), StreamPosition{"shard_1": "1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"key_2"}) || to["shard_1"] != "2" {
+		t.Errorf("expected to read key_2, got %v at %v", keys, to)
+	}
+
+	// The next read reuses both.
+	if _, to, err = s.Get(context.Background(), to); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if listShards != 1 || getShardIterator != 1 {
+		t.Errorf("expected the shard list and iterator to be reused, but ListShards was called %d times, and GetShardIterator %d times", listShards, getShardIterator)
+	}
+
+	// When the position is reset, a new iterator is requested.
+	if keys, _, err = s.Get(context.Background(), StreamPosition{"shard_1": "1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getShardIterator != 2 || !reflect.DeepEqual(keys, []string{"key_2"}) {
+		t.Errorf("expected a new iterator to read from the reset position, got %d iterators and keys %v", getShardIterator, keys)
+	}
+
+	// When the iterator has expired, a new one is requested from the position.
+	expired["after_2"] = true
+	if _, to, err = s.Get(context.Background(), to); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if getShardIterator != 3 || to["shard_1"] != "2" {
+		t.Errorf("expected a new iterator to replace the expired one, got %d iterators, and position %v", getShardIterator, to)
+	}
+}
@@ -0,0 +1,71 @@
+package expiry
+
+import "sync"
+
+// defaultRecentIDs is the default number of record IDs remembered for ignoring duplicate records.
+const defaultRecentIDs = 10000
+
+// recentIDs is a fixed size set of IDs. When the set is full, the oldest IDs are forgotten.
+type recentIDs struct {
+	mutex sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+// readerIDs holds the recently read IDs of each reader separately, so that a record read by one reader isn't
+// treated as a duplicate by another.
+type readerIDs struct {
+	mutex   sync.Mutex
+	size    int
+	readers map[string]*recentIDs
+}
+
+func newReaderIDs(size int) *readerIDs {
+	return &readerIDs{
+		size:    size,
+		readers: map[string]*recentIDs{},
+	}
+}
+
+// seen adds the ID to the reader's set, returning true if the reader has already read it. Readers without
+// an ID can't be told apart, so nothing is treated as a duplicate.
+func (r *readerIDs) seen(reader, id string) bool {
+	if r == nil || reader == "" {
+		return false
+	}
+	r.mutex.Lock()
+	ids, ok := r.readers[reader]
+	if !ok {
+		ids = newRecentIDs(r.size)
+		r.readers[reader] = ids
+	}
+	r.mutex.Unlock()
+	return ids.seen(id)
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{
+		ids:   make(map[string]struct{}, size),
+		order: make([]string, size),
+	}
+}
+
+// seen adds the ID to the set, returning true if it was already present.
+func (r *recentIDs) seen(id string) bool {
+	if r == nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.ids[id]; ok {
+		return true
+	}
+	if oldest := r.order[r.next]; oldest != "" {
+		delete(r.ids, oldest)
+	}
+	r.order[r.next] = id
+	r.next = (r.next + 1) % len(r.order)
+	r.ids[id] = struct{}{}
+	return false
+}
@@ -0,0 +1,144 @@
+package expiry
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// backoff defines how failed requests are retried.
+type backoff struct {
+	// attempts is the maximum number of attempts, including the first.
+	attempts int
+	// base is the delay before the first retry, which doubles on each subsequent retry.
+	base time.Duration
+	// max is the maximum delay between retries.
+	max time.Duration
+	// sleep waits for the duration, or until the context is done. It's replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+var defaultPutRetry = backoff{
+	attempts: 5,
+	base:     time.Millisecond * 100,
+	max:      time.Second * 2,
+	sleep:    sleepContext,
+}
+
+// sleepContext waits for the duration, or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait sleeps for a random duration between zero and the exponential backoff delay of the retry, so that
+// concurrent writers don't retry at the same time. If the context is done first, its error is returned.
+func (b backoff) wait(ctx context.Context, retry int) error {
+	d := b.base << uint(retry)
+	if d > b.max || d <= 0 {
+		d = b.max
+	}
+	if d <= 0 || b.sleep == nil {
+		return ctx.Err()
+	}
+	return b.sleep(ctx, time.Duration(rand.Int63n(int64(d))))
+}
+
+// PutError is returned when keys could not be written to the stream.
+type PutError struct {
+	// Keys which were not written to the stream.
+	Keys []string
+	// Attempts made to write the keys.
+	Attempts int
+	// Err is the last error encountered.
+	Err error
+}
+
+func (e *PutError) Error() string {
+	return fmt.Sprintf("Put: failed to put %d keys after %d attempts: %v", len(e.Keys), e.Attempts, e.Err)
+}
+
+func joinPutErrors(errs []*PutError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	joined := &PutError{}
+	for _, e := range errs {
+		joined.Keys = append(joined.Keys, e.Keys...)
+		if e.Attempts > joined.Attempts {
+			joined.Attempts = e.Attempts
+		}
+		joined.Err = e.Err
+	}
+	return joined
+}
+
+// isThrottled returns true if the request was rejected due to throughput limits.
+func isThrottled(code string) bool {
+	return code == kinesis.ErrCodeProvisionedThroughputExceededException || code == kinesis.ErrCodeKMSThrottlingException
+}
+
+// putRecords writes the records to the stream, retrying records which failed with jittered exponential backoff.
+// recordKeys contains the keys held in each record.
+func (p Stream) putRecords(ctx context.Context, records []*kinesis.PutRecordsRequestEntry, recordKeys [][]string) *PutError {
+	var attempt int
+	for {
+		attempt++
+		out, err := p.svc.PutRecordsWithContext(ctx, &kinesis.PutRecordsInput{
+			StreamName: aws.String(p.Name),
+			Records:    records,
+		})
+		if err != nil {
+			aerr, isAWSError := err.(awserr.Error)
+			if !isAWSError || !isThrottled(aerr.Code()) || attempt >= p.putRetry.attempts {
+				return &PutError{Keys: flatten(recordKeys), Attempts: attempt, Err: err}
+			}
+			if waitErr := p.putRetry.wait(ctx, attempt-1); waitErr != nil {
+				return &PutError{Keys: flatten(recordKeys), Attempts: attempt, Err: waitErr}
+			}
+			continue
+		}
+		if aws.Int64Value(out.FailedRecordCount) == 0 {
+			return nil
+		}
+		// Retry just the failed records.
+		var failed []*kinesis.PutRecordsRequestEntry
+		var failedKeys [][]string
+		for i, r := range out.Records {
+			if i >= len(records) || r.ErrorCode == nil {
+				continue
+			}
+			failed = append(failed, records[i])
+			failedKeys = append(failedKeys, recordKeys[i])
+			err = fmt.Errorf("%s: %s", aws.StringValue(r.ErrorCode), aws.StringValue(r.ErrorMessage))
+		}
+		records, recordKeys = failed, failedKeys
+		if len(records) == 0 {
+			return nil
+		}
+		if attempt >= p.putRetry.attempts {
+			return &PutError{Keys: flatten(recordKeys), Attempts: attempt, Err: err}
+		}
+		if waitErr := p.putRetry.wait(ctx, attempt-1); waitErr != nil {
+			return &PutError{Keys: flatten(recordKeys), Attempts: attempt, Err: waitErr}
+		}
+	}
+}
+
+func flatten(values [][]string) (op []string) {
+	for _, v := range values {
+		op = append(op, v...)
+	}
+	return
+}
@@ -0,0 +1,152 @@
+package expiry
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// ShardEnd is the position of a closed shard which has been read to the end. When a stream is resharded,
+// the parent shards are closed, and new records are written to their child shards.
+const ShardEnd SequenceNumber = "SHARD_END"
+
+// shardRead describes how Get reads a shard.
+type shardRead struct {
+	shard ShardID
+	// from is the sequence number of the last record read, if any.
+	from SequenceNumber
+	// trimHorizon is true if the shard should be read from its first record.
+	trimHorizon bool
+	// closed is true if no more records will be written to the shard.
+	closed bool
+}
+
+func (sr shardRead) iteratorType() string {
+	if _, ok := sr.from.timestamp(); ok {
+		return kinesis.ShardIteratorTypeAtTimestamp
+	}
+	switch {
+	case sr.from != "":
+		return kinesis.ShardIteratorTypeAfterSequenceNumber
+	case sr.trimHorizon:
+		return kinesis.ShardIteratorTypeTrimHorizon
+	}
+	return kinesis.ShardIteratorTypeLatest
+}
+
+// Shard describes a shard of a stream for PlanReads, so that streams other than Kinesis, e.g. DynamoDB
+// Streams, can follow the lineage of their shards in the same way.
+type Shard struct {
+	ID ShardID
+	// Parents are the shards which were split or merged to create the shard, if any.
+	Parents []ShardID
+	// EndingSequenceNumber is the sequence number of the last record of a closed shard, or empty if the
+	// shard is open.
+	EndingSequenceNumber SequenceNumber
+}
+
+// Closed returns true if no more records will be written to the shard.
+func (s Shard) Closed() bool {
+	return s.EndingSequenceNumber != ""
+}
+
+// ShardRead describes where a shard is read from.
+type ShardRead struct {
+	Shard ShardID
+	// From is the position of the last record read, if any.
+	From SequenceNumber
+	// TrimHorizon is true if the shard should be read from its first record.
+	TrimHorizon bool
+	// Closed is true if no more records will be written to the shard.
+	Closed bool
+}
+
+// PlanReads decides which shards to read, and where to read them from. to contains the positions of the
+// shards which aren't being read, which must be retained.
+//
+//   - Shards with a position are read from the position, unless they have been read to the end.
+//   - Shards without a position, whose parents are being tracked, are new child shards. They're read from
+//     their first record once all of their parents have been read to the end, or have expired. Until then,
+//     they aren't read, so that records for the same keys are read in order.
+//   - Other shards without a position are read from the latest record, unless they're closed.
+//   - Closed shards which have been read to the end are kept until they're no longer listed, and until
+//     their children have positions of their own, then dropped.
+func PlanReads(shards []Shard, from StreamPosition) (reads []ShardRead, to StreamPosition) {
+	to = StreamPosition{}
+	listed := make(map[ShardID]bool, len(shards))
+	for _, s := range shards {
+		listed[s.ID] = true
+		if pos := from[s.ID]; pos == ShardEnd || (pos != "" && pos == s.EndingSequenceNumber) {
+			to[s.ID] = ShardEnd
+		}
+	}
+	for _, s := range shards {
+		pos := from[s.ID]
+		if to[s.ID] == ShardEnd {
+			continue
+		}
+		if pos != "" {
+			to[s.ID] = pos
+			reads = append(reads, ShardRead{Shard: s.ID, From: pos, Closed: s.Closed()})
+			continue
+		}
+		tracked, drained := parentState(s, from, to, listed)
+		switch {
+		case tracked && !drained:
+			// Wait for the parents to be read to the end.
+		case tracked && drained:
+			reads = append(reads, ShardRead{Shard: s.ID, TrimHorizon: true, Closed: s.Closed()})
+		case !s.Closed():
+			reads = append(reads, ShardRead{Shard: s.ID})
+		}
+	}
+	// Children which are waiting to be read, or have no records yet, need to know that their parents have
+	// been read to the end, even once the parents are no longer listed.
+	for _, s := range shards {
+		if to[s.ID] != "" {
+			continue
+		}
+		for _, parent := range s.Parents {
+			if from[parent] == ShardEnd {
+				to[parent] = ShardEnd
+			}
+		}
+	}
+	return
+}
+
+// parentState returns whether any of the shard's parents are being tracked, and if so, whether all of the
+// tracked parents have been read to the end, or have expired from the stream.
+func parentState(s Shard, from, to StreamPosition, listed map[ShardID]bool) (tracked, drained bool) {
+	drained = true
+	for _, parent := range s.Parents {
+		if from[parent] == "" {
+			continue
+		}
+		tracked = true
+		if to[parent] != ShardEnd && listed[parent] {
+			drained = false
+		}
+	}
+	return
+}
+
+// planReads plans the reads of the Kinesis shards, see PlanReads.
+func planReads(shards []*kinesis.Shard, from StreamPosition) (reads []shardRead, to StreamPosition) {
+	ks := make([]Shard, len(shards))
+	for i, s := range shards {
+		ks[i] = Shard{ID: ShardID(aws.StringValue(s.ShardId))}
+		for _, p := range []*string{s.ParentShardId, s.AdjacentParentShardId} {
+			if p != nil && *p != "" {
+				ks[i].Parents = append(ks[i].Parents, ShardID(*p))
+			}
+		}
+		if s.SequenceNumberRange != nil {
+			ks[i].EndingSequenceNumber = SequenceNumber(aws.StringValue(s.SequenceNumberRange.EndingSequenceNumber))
+		}
+	}
+	planned, to := PlanReads(ks, from)
+	for _, r := range planned {
+		reads = append(reads, shardRead{shard: r.Shard, from: r.From, trimHorizon: r.TrimHorizon, closed: r.Closed})
+	}
+	return
+}
@@ -0,0 +1,212 @@
+package expiry
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func openShard(id string, parents ...string) *kinesis.Shard {
+	s := &kinesis.Shard{
+		ShardId:             aws.String(id),
+		SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("0")},
+	}
+	if len(parents) > 0 {
+		s.ParentShardId = aws.String(parents[0])
+	}
+	if len(parents) > 1 {
+		s.AdjacentParentShardId = aws.String(parents[1])
+	}
+	return s
+}
+
+func closedShard(id string, parents ...string) *kinesis.Shard {
+	s := openShard(id, parents...)
+	s.SequenceNumberRange.EndingSequenceNumber = aws.String("100")
+	return s
+}
+
+func TestPlanReads(t *testing.T) {
+	tests := []struct {
+		name          string
+		shards        []*kinesis.Shard
+		from          StreamPosition
+		expectedReads []shardRead
+		expectedTo    StreamPosition
+	}{
+		{
+			name:   "new shards are read from the latest record",
+			shards: []*kinesis.Shard{openShard("shard_1"), openShard("shard_2")},
+			from:   StreamPosition{},
+			expectedReads: []shardRead{
+				{shard: "shard_1"},
+				{shard: "shard_2"},
+			},
+			expectedTo: StreamPosition{},
+		},
+		{
+			name:   "closed shards without a position aren't read",
+			shards: []*kinesis.Shard{closedShard("shard_1"), openShard("shard_2", "shard_1")},
+			from:   StreamPosition{},
+			expectedReads: []shardRead{
+				{shard: "shard_2"},
+			},
+			expectedTo: StreamPosition{},
+		},
+		{
+			name:   "shards are read from their position",
+			shards: []*kinesis.Shard{openShard("shard_1"), closedShard("shard_2")},
+			from:   StreamPosition{"shard_1": "1", "shard_2": "2"},
+			expectedReads: []shardRead{
+				{shard: "shard_1", from: "1"},
+				{shard: "shard_2", from: "2", closed: true},
+			},
+			expectedTo: StreamPosition{"shard_1": "1", "shard_2": "2"},
+		},
+		{
+			name:   "children wait for their parent to be read to the end",
+			shards: []*kinesis.Shard{closedShard("parent"), openShard("child_1", "parent"), openShard("child_2", "parent")},
+			from:   StreamPosition{"parent": "1"},
+			expectedReads: []shardRead{
+				{shard: "parent", from: "1", closed: true},
+			},
+			expectedTo: StreamPosition{"parent": "1"},
+		},
+		{
+			name:   "children are read from their first record once their parent has been read to the end",
+			shards: []*kinesis.Shard{closedShard("parent"), openShard("child_1", "parent"), openShard("child_2", "parent")},
+			from:   StreamPosition{"parent": ShardEnd},
+			expectedReads: []shardRead{
+				{shard: "child_1", trimHorizon: true},
+				{shard: "child_2", trimHorizon: true},
+			},
+			expectedTo: StreamPosition{"parent": ShardEnd},
+		},
+		{
+			name:   "merged shards wait for both parents to be read to the end",
+			shards: []*kinesis.Shard{closedShard("parent_1"), closedShard("parent_2"), openShard("child", "parent_1", "parent_2")},
+			from:   StreamPosition{"parent_1": ShardEnd, "parent_2": "2"},
+			expectedReads: []shardRead{
+				{shard: "parent_2", from: "2", closed: true},
+			},
+			expectedTo: StreamPosition{"parent_1": ShardEnd, "parent_2": "2"},
+		},
+		{
+			name:   "merged shards are read once both parents have been read to the end",
+			shards: []*kinesis.Shard{closedShard("parent_1"), closedShard("parent_2"), openShard("child", "parent_1", "parent_2")},
+			from:   StreamPosition{"parent_1": ShardEnd, "parent_2": ShardEnd},
+			expectedReads: []shardRead{
+				{shard: "child", trimHorizon: true},
+			},
+			expectedTo: StreamPosition{"parent_1": ShardEnd, "parent_2": ShardEnd},
+		},
+		{
+			name:   "children of expired parents are read from their first record",
+			shards: []*kinesis.Shard{openShard("child", "parent")},
+			from:   StreamPosition{"parent": "1"},
+			expectedReads: []shardRead{
+				{shard: "child", trimHorizon: true},
+			},
+			expectedTo: StreamPosition{},
+		},
+		{
+			name:   "closed shards whose position is their last record have been read to the end",
+			shards: []*kinesis.Shard{closedShard("parent"), openShard("child", "parent")},
+			from:   StreamPosition{"parent": "100"},
+			expectedReads: []shardRead{
+				{shard: "child", trimHorizon: true},
+			},
+			expectedTo: StreamPosition{"parent": ShardEnd},
+		},
+		{
+			name:          "parents which have been read to the end are dropped once their children have positions",
+			shards:        []*kinesis.Shard{openShard("child", "parent")},
+			from:          StreamPosition{"parent": ShardEnd, "child": "3", "removed": "4"},
+			expectedReads: []shardRead{{shard: "child", from: "3"}},
+			expectedTo:    StreamPosition{"child": "3"},
+		},
+	}
+
+	for _, test := range tests {
+		reads, to := planReads(test.shards, test.from)
+		if !reflect.DeepEqual(reads, test.expectedReads) {
+			t.Errorf("%s: expected reads %+v, got %+v", test.name, test.expectedReads, reads)
+		}
+		if !reflect.DeepEqual(to, test.expectedTo) {
+			t.Errorf("%s: expected position %v, got %v", test.name, test.expectedTo, to)
+		}
+	}
+}
+
+func TestGetFollowsShardLineage(t *testing.T) {
+	shards := []*kinesis.Shard{closedShard("parent"), openShard("child", "parent")}
+	// Each shard has one record left to read.
+	records := map[string]*kinesis.Record{
+		"parent": {SequenceNumber: aws.String("parent_2"), Data: []byte(`{ "keys": ["parent_key"], "ts": "2018-06-11T14:00:00.000Z" }`)},
+		"child":  {SequenceNumber: aws.String("child_1"), Data: []byte(`{ "keys": ["child_key"], "ts": "2018-06-11T14:00:00.000Z" }`)},
+	}
+	var iteratorTypes []string
+	s := NewStream("test")
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: shards}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			iteratorTypes = append(iteratorTypes, *input.ShardId+":"+*input.ShardIteratorType)
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(*input.ShardId + ":0")}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			switch *input.ShardIterator {
+			case "parent:0":
+				// The last record of a closed shard has no next iterator.
+				return &kinesis.GetRecordsOutput{Records: []*kinesis.Record{records["parent"]}}, nil
+			case "child:0":
+				return &kinesis.GetRecordsOutput{Records: []*kinesis.Record{records["child"]}, NextShardIterator: aws.String("child:1")}, nil
+			}
+			return &kinesis.GetRecordsOutput{NextShardIterator: input.ShardIterator}, nil
+		},
+	}
+
+	keys, to, err := s.Get(context.Background(), StreamPosition{"parent": "parent_1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"parent_key"}) {
+		t.Errorf("expected only the parent to be read, got keys %v", keys)
+	}
+	if !reflect.DeepEqual(to, StreamPosition{"parent": ShardEnd}) {
+		t.Errorf("expected the parent to have been read to the end, got %v", to)
+	}
+
+	keys, to, err = s.Get(context.Background(), to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"child_key"}) {
+		t.Errorf("expected the child to be read, got keys %v", keys)
+	}
+	if !reflect.DeepEqual(to, StreamPosition{"parent": ShardEnd, "child": "child_1"}) {
+		t.Errorf("expected the child to have a position, got %v", to)
+	}
+
+	// The parent expires from the stream, and the list of shards is requested again once it expires.
+	shards = shards[1:]
+	now := time.Now().Add(defaultShardListTTL)
+	s.shardList.now = func() time.Time { return now }
+	_, to, err = s.Get(context.Background(), to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(to, StreamPosition{"child": "child_1"}) {
+		t.Errorf("expected the expired parent to be dropped, got %v", to)
+	}
+	// The child's iterator is reused by the last Get.
+	expectedIteratorTypes := []string{"parent:AFTER_SEQUENCE_NUMBER", "child:TRIM_HORIZON"}
+	if !reflect.DeepEqual(iteratorTypes, expectedIteratorTypes) {
+		t.Errorf("expected iterator types %v, got %v", expectedIteratorTypes, iteratorTypes)
+	}
+}
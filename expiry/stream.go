@@ -1,107 +1,258 @@
 package expiry
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
 // KinesisStream contains all of the functionality used to access Kinesis.
 type KinesisStream interface {
-	PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
-	GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error)
-	GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
-	ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error)
+	PutRecordsWithContext(ctx aws.Context, input *kinesis.PutRecordsInput, opts ...request.Option) (*kinesis.PutRecordsOutput, error)
+	GetShardIteratorWithContext(ctx aws.Context, input *kinesis.GetShardIteratorInput, opts ...request.Option) (*kinesis.GetShardIteratorOutput, error)
+	GetRecordsWithContext(ctx aws.Context, input *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error)
+	ListShardsWithContext(ctx aws.Context, input *kinesis.ListShardsInput, opts ...request.Option) (*kinesis.ListShardsOutput, error)
 }
 
 // Stream provides a way to send and receive events using Kinesis.
 type Stream struct {
 	Name string
-	// maxPutSize is the target size of a single HTTP request which pushes data to Kinesis.
+	// maxPutSize is the maximum size of a single HTTP request which pushes data to Kinesis, including
+	// the partition keys of the records.
 	maxPutSize int
-	// maxRecordSize is the target size of a Kinesis record. Multiple records are sent in a single request.
+	// maxPutRecords is the maximum number of records pushed to Kinesis in a single HTTP request.
+	maxPutRecords int
+	// maxRecordSize is the maximum size of a Kinesis record, including its partition key. Multiple records
+	// are sent in a single request.
 	maxRecordSize int
 	svc           KinesisStream
+	// seen contains the IDs of records which have recently been read by each reader, so that duplicates can
+	// be ignored.
+	seen *readerIDs
+	// putRetry controls how records which fail to be written are retried.
+	putRetry backoff
+	// maxConcurrentShards is the maximum number of shards read at the same time by Get.
+	maxConcurrentShards int
+	// maxReadsPerShard is the maximum number of GetRecords requests made to each shard by a single Get,
+	// which limits how long Get spends catching up when it's behind the tip of the shard.
+	maxReadsPerShard int
+	// getRetry controls how throttled reads are retried.
+	getRetry backoff
+	// limiter keeps reads within the Kinesis limit for each shard.
+	limiter *shardLimiter
+	// lag is how far behind the tip of each shard the last read was.
+	lag *shardLag
+	// shardList holds the list of shards between calls to Get.
+	shardList *shardListCache
+	// iterators holds the next iterator of each shard between calls to Get.
+	iterators *iteratorCache
+	// Backlog limits the number of records read by Get. If the limit is exceeded, Get returns a
+	// *BacklogExceededError. By default, the backlog isn't limited.
+	Backlog BacklogLimit
 }
 
 const (
-	// defaultMaxPutSize is the default target size of a single HTTP request which pushes data to Kinesis.
-	defaultMaxPutSize = 1024 * 1024 * 2 // 2MB
-	// defaultMaxRecordSize is the default target size of a Kinesis record. Multiple records are sent in a single request.
-	defaultMaxRecordSize = 512 * 1024 // 512KB
+	// kinesisMaxPutSize is the maximum size of a PutRecords request allowed by Kinesis.
+	kinesisMaxPutSize = 5 * 1024 * 1024 // 5MB
+	// kinesisMaxPutRecords is the maximum number of records in a PutRecords request allowed by Kinesis.
+	kinesisMaxPutRecords = 500
+	// kinesisMaxRecordSize is the maximum size of a record allowed by Kinesis.
+	kinesisMaxRecordSize = 1024 * 1024 // 1MB
 )
 
+// ErrRecordTooLarge is returned when a key is too large to fit into a Kinesis record.
+var ErrRecordTooLarge = errors.New("Put: key is too large to fit into a record")
+
 // NewStream creates a new pusher to stream events to Kinesis.
 func NewStream(name string) Stream {
 	return Stream{
-		Name:          name,
-		maxRecordSize: defaultMaxRecordSize,
-		maxPutSize:    defaultMaxPutSize,
-		svc:           kinesis.New(session.New()),
+		Name:                name,
+		maxRecordSize:       kinesisMaxRecordSize,
+		maxPutSize:          kinesisMaxPutSize,
+		maxPutRecords:       kinesisMaxPutRecords,
+		svc:                 kinesis.New(session.New()),
+		seen:                newReaderIDs(defaultRecentIDs),
+		putRetry:            defaultPutRetry,
+		maxConcurrentShards: defaultMaxConcurrentShards,
+		maxReadsPerShard:    defaultMaxReadsPerShard,
+		getRetry:            defaultGetRetry,
+		limiter:             newShardLimiter(kinesisReadsPerSecond),
+		lag:                 newShardLag(),
+		shardList:           newShardListCache(defaultShardListTTL),
+		iterators:           newIteratorCache(),
 	}
 }
 
 // Put pushes events onto the stream.
-func (p Stream) Put(keys []string) error {
-	for _, section := range chunk(keys, p.maxPutSize) { // 1MB per request
-		records, err := createPutRecords(section, p.maxRecordSize)
-		if err != nil {
-			return err
-		}
-		input := &kinesis.PutRecordsInput{
-			StreamName: aws.String(p.Name),
-			Records:    records,
+func (p Stream) Put(ctx context.Context, keys []string) error {
+	return p.putMessage(ctx, createRandomKey(), "", keys)
+}
+
+// PutFrom pushes events onto the stream, tagging the records with the producer, so that GetFor skips them
+// when it's called with the producer as the reader. The producer removes invalidated data from its own
+// cache when it writes the records, e.g. changes.NewNotifierFor uses the ID of the Engine's Observer.
+func (p Stream) PutFrom(ctx context.Context, producer string, keys []string) error {
+	return p.putMessage(ctx, createRandomKey(), producer, keys)
+}
+
+// PutMessage pushes events onto the stream, using the id to identify the records. If the same message is
+// sent more than once, readers will ignore the duplicates. Records which fail to be written are retried, if
+// they still can't be written, a *PutError lists the keys which weren't written.
+func (p Stream) PutMessage(ctx context.Context, id string, keys []string) error {
+	return p.putMessage(ctx, id, "", keys)
+}
+
+func (p Stream) putMessage(ctx context.Context, id, producer string, keys []string) error {
+	maxRecordSize := smallest(p.maxRecordSize, kinesisMaxRecordSize, p.maxPutSize)
+	records, recordKeys, tooLarge, err := createPutRecords(id, producer, keys, maxRecordSize)
+	if err != nil {
+		return err
+	}
+	var errs []*PutError
+	if len(tooLarge) > 0 {
+		errs = append(errs, &PutError{Keys: tooLarge, Err: ErrRecordTooLarge})
+	}
+	maxPutRecords := smallest(p.maxPutRecords, kinesisMaxPutRecords)
+	maxPutSize := smallest(p.maxPutSize, kinesisMaxPutSize)
+	for _, b := range batchRecords(records, maxPutRecords, maxPutSize) {
+		if err := p.putRecords(ctx, records[b.start:b.end], recordKeys[b.start:b.end]); err != nil {
+			errs = append(errs, err)
 		}
-		if _, err := p.svc.PutRecords(input); err != nil {
-			return err
+	}
+	return joinPutErrors(errs)
+}
+
+func smallest(values ...int) (op int) {
+	for i, v := range values {
+		if i == 0 || v < op {
+			op = v
 		}
 	}
-	return nil
+	return
+}
+
+// partitionKeyLength is the length of the keys created by createRandomKey.
+const partitionKeyLength = 64
+
+func createRandomKey() string {
+	vs := make([]byte, partitionKeyLength/2)
+	rand.Read(vs)
+	op := make([]byte, hex.EncodedLen(len(vs)))
+	hex.Encode(op, vs)
+	return string(op)
 }
 
-func createPutRecords(keys []string, size int) ([]*kinesis.PutRecordsRequestEntry, error) {
-	chunks := chunk(keys, size)
-	records := make([]*kinesis.PutRecordsRequestEntry, len(chunks))
-	for i, sliceOfKeys := range chunks {
-		sd := NewStreamData(sliceOfKeys)
+// recordOverhead is the maximum size of a record which contains no keys, including its partition key.
+func recordOverhead(id, producer string) int {
+	empty := StreamData{
+		ID:       recordID(id, math.MaxInt32),
+		Producer: producer,
+		Keys:     []string{},
+		// Times are encoded with trailing zeros removed, so this is the longest possible time.
+		Time: time.Date(9999, time.December, 31, 23, 59, 59, 999999999, time.UTC),
+	}
+	data, _ := json.Marshal(empty)
+	return len(data) + partitionKeyLength
+}
+
+func recordID(id string, part int) string {
+	return id + "/" + strconv.Itoa(part)
+}
+
+// createPutRecords packs the keys into as few records as possible, without exceeding maxSize once each record
+// is JSON encoded and its partition key is added. recordKeys contains the keys in each record. Keys which are
+// too large to fit into a record on their own are returned in tooLarge.
+func createPutRecords(id, producer string, keys []string, maxSize int) (records []*kinesis.PutRecordsRequestEntry, recordKeys [][]string, tooLarge []string, err error) {
+	overhead := recordOverhead(id, producer)
+	var current []string
+	var currentSize int
+	add := func() error {
+		sd := NewStreamData(current)
+		sd.ID = recordID(id, len(records))
+		sd.Producer = producer
 		data, err := json.Marshal(sd)
 		if err != nil {
-			return records, err
+			return err
 		}
-		records[i] = &kinesis.PutRecordsRequestEntry{
+		record := &kinesis.PutRecordsRequestEntry{
 			PartitionKey: aws.String(createRandomKey()),
 			Data:         data,
 		}
+		if size := recordSize(record); size > maxSize {
+			return fmt.Errorf("Put: record of %d bytes exceeds the maximum of %d bytes", size, maxSize)
+		}
+		records = append(records, record)
+		recordKeys = append(recordKeys, current)
+		current, currentSize = nil, 0
+		return nil
 	}
-	return records, nil
+	for _, k := range keys {
+		var encoded []byte
+		if encoded, err = json.Marshal(k); err != nil {
+			return
+		}
+		if overhead+len(encoded) > maxSize {
+			tooLarge = append(tooLarge, k)
+			continue
+		}
+		// Keys after the first are separated by a comma.
+		if len(current) > 0 && overhead+currentSize+1+len(encoded) > maxSize {
+			if err = add(); err != nil {
+				return
+			}
+		}
+		if len(current) > 0 {
+			currentSize++
+		}
+		current = append(current, k)
+		currentSize += len(encoded)
+	}
+	if len(current) > 0 {
+		err = add()
+	}
+	return
 }
 
-func createRandomKey() string {
-	vs := make([]byte, 32)
-	rand.Read(vs)
-	op := make([]byte, hex.EncodedLen(len(vs)))
-	hex.Encode(op, vs)
-	return string(op)
+func recordSize(r *kinesis.PutRecordsRequestEntry) int {
+	return len(r.Data) + len(aws.StringValue(r.PartitionKey))
 }
 
-func chunk(values []string, maxLength int) (op [][]string) {
-	var chunkSize int
-	var startIndex, endIndex int
-	var v string
-	for endIndex, v = range values {
-		if chunkSize >= maxLength {
-			op = append(op, values[startIndex:endIndex])
-			startIndex = endIndex
-			chunkSize = 0
+// span is a range of indices [start, end).
+type span struct {
+	start, end int
+}
+
+// batchRecords splits records into PutRecords requests without exceeding the maximum number of records or
+// total size of each request.
+func batchRecords(records []*kinesis.PutRecordsRequestEntry, maxRecords, maxSize int) (op []span) {
+	var current span
+	var size int
+	for i, r := range records {
+		rs := recordSize(r)
+		if current.end > current.start && (current.end-current.start >= maxRecords || size+rs > maxSize) {
+			op = append(op, current)
+			current = span{start: i, end: i}
+			size = 0
 		}
-		chunkSize += len(v)
+		current.end++
+		size += rs
+	}
+	if current.end > current.start {
+		op = append(op, current)
 	}
-	op = append(op, values[startIndex:])
 	return
 }
 
@@ -114,41 +265,160 @@ type SequenceNumber string
 // StreamPosition stores the reader's position within each shard.
 type StreamPosition map[ShardID]SequenceNumber
 
-// Get returns all of the keys added to the stream since the StreamPosition was encountered.
-func (p Stream) Get(from StreamPosition) (keys []string, to StreamPosition, err error) {
-	shards, err := p.listShards()
+// Get returns all of the keys added to the stream since the StreamPosition was encountered. Shards are read concurrently, and
+// keys are returned in shard order. When the stream is resharded, new child shards are read from their
+// first record once their parents have been read to the end, see PlanReads. If a position has been
+// trimmed from the stream, or isn't valid, a *PositionExpiredError is returned, and if there are more records
+// to read than the Backlog allows, a *BacklogExceededError is returned. If the context is done before all of
+// the shards have been read, the keys and position read so far are returned with the context's error.
+// Duplicate records aren't ignored, because the readers of the stream can't be told apart, see GetFor.
+func (p Stream) Get(ctx context.Context, from StreamPosition) (keys []string, to StreamPosition, err error) {
+	return p.GetFor(ctx, "", from)
+}
+
+// GetFor returns the keys added to the stream since the StreamPosition, in the same way as Get, but ignores
+// records which have already been read by the reader, e.g. when an outbox.Relay sends a message again.
+// Each reader, e.g. each changes.Observer, has its own set of recently read records. Records written by
+// PutFrom with the reader as the producer are skipped, but the position still moves past them.
+func (p Stream) GetFor(ctx context.Context, reader string, from StreamPosition) (keys []string, to StreamPosition, err error) {
+	shards, err := p.cachedShards(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
 		err = fmt.Errorf("Get: failed to list all shards: %v", err)
 		return
 	}
-	to = map[ShardID]SequenceNumber{}
-	for _, shardID := range shards {
-		records, t, read, getRecordsError := p.getRecords(shardID, from[shardID])
-		if getRecordsError != nil {
-			err = fmt.Errorf("Get: failed to get records: %v", getRecordsError)
-			return
+	reads, to := planReads(shards, from)
+	results, err := p.readShards(ctx, reads, newBacklog(p.Backlog))
+	if err != nil && err != ctx.Err() {
+		return
+	}
+	for i, sr := range reads {
+		r := results[i]
+		if r.ended {
+			to[sr.shard] = ShardEnd
+			// The children of the shard may not have been listed yet.
+			p.shardList.invalidate()
 		}
-		if !read {
+		if !r.read {
 			continue
 		}
-		data, getDataError := getDataFromRecords(records)
-		if getDataError != nil {
-			err = fmt.Errorf("Get: failed to get data from records: %v", getDataError)
-			return
-		}
-		for _, d := range data {
+		for _, d := range r.data {
+			if d.ID != "" && p.seen.seen(reader, d.ID) {
+				continue
+			}
+			if reader != "" && d.Producer == reader {
+				continue
+			}
 			keys = append(keys, d.Keys...)
 		}
-		to[shardID] = t
+		if !r.ended {
+			to[sr.shard] = r.to
+		}
 	}
 	return
 }
 
-func (p Stream) listShards() (shardIDs []ShardID, err error) {
+// defaultMaxConcurrentShards is the default number of shards read at the same time by Get.
+const defaultMaxConcurrentShards = 8
+
+type shardResult struct {
+	data  []StreamData
+	to    SequenceNumber
+	read  bool
+	ended bool
+}
+
+// readShards reads the shards using a pool of workers. Once a shard fails to be read, no more shards are
+// started, the shards being read are cancelled, and the first error is returned. If the context is done,
+// the records read so far are returned with the context's error.
+func (p Stream) readShards(ctx context.Context, reads []shardRead, b *backlog) (results []shardResult, err error) {
+	results = make([]shardResult, len(reads))
+	workers := smallest(p.maxConcurrentShards, len(reads))
+	if workers < 1 {
+		workers = 1
+	}
+	work := make(chan int)
+	cancel := make(chan struct{})
+	// Shards which are being read when another shard fails are cancelled, rather than waited for. The
+	// parent context's error is checked separately, so that a cancelled read isn't taken for a stopped Get.
+	readCtx, cancelReads := context.WithCancel(ctx)
+	defer cancelReads()
+	var once sync.Once
+	fail := func(e error) {
+		once.Do(func() {
+			err = e
+			close(cancel)
+			cancelReads()
+		})
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				select {
+				case <-cancel:
+					continue
+				default:
+				}
+				records, t, read, ended, getRecordsError := p.getRecords(readCtx, reads[i], b)
+				switch getRecordsError.(type) {
+				case *PositionExpiredError, *BacklogExceededError:
+					fail(getRecordsError)
+					continue
+				}
+				if getRecordsError != nil && getRecordsError != readCtx.Err() {
+					fail(fmt.Errorf("Get: failed to get records: %v", getRecordsError))
+					continue
+				}
+				data, getDataError := getDataFromRecords(records)
+				if getDataError != nil {
+					fail(fmt.Errorf("Get: failed to get data from records: %v", getDataError))
+					continue
+				}
+				results[i] = shardResult{data: data, to: t, read: read, ended: ended}
+			}
+		}()
+	}
+send:
+	for i := range reads {
+		select {
+		case work <- i:
+		case <-cancel:
+			break send
+		}
+	}
+	close(work)
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// cachedShards returns the list of shards, which is reused until it expires.
+func (p Stream) cachedShards(ctx context.Context) (shards []*kinesis.Shard, err error) {
+	shards, ok := p.shardList.get()
+	if ok {
+		return
+	}
+	shards, err = p.listShards(ctx)
+	if err != nil {
+		return
+	}
+	p.shardList.set(shards)
+	return
+}
+
+func (p Stream) listShards(ctx context.Context) (shards []*kinesis.Shard, err error) {
 	var nextToken *string
 	var lso *kinesis.ListShardsOutput
 	for {
-		lso, err = p.svc.ListShards(&kinesis.ListShardsInput{
+		lso, err = p.svc.ListShardsWithContext(ctx, &kinesis.ListShardsInput{
 			StreamName: aws.String(p.Name),
 			MaxResults: aws.Int64(1000),
 			NextToken:  nextToken,
@@ -156,9 +426,7 @@ func (p Stream) listShards() (shardIDs []ShardID, err error) {
 		if err != nil {
 			return
 		}
-		for _, s := range lso.Shards {
-			shardIDs = append(shardIDs, ShardID(*s.ShardId))
-		}
+		shards = append(shards, lso.Shards...)
 		if lso.NextToken == nil {
 			break
 		}
@@ -167,44 +435,172 @@ func (p Stream) listShards() (shardIDs []ShardID, err error) {
 	return
 }
 
-func (p Stream) getRecords(shard ShardID, from SequenceNumber) (records []*kinesis.Record, to SequenceNumber, read bool, err error) {
-	gsii := &kinesis.GetShardIteratorInput{
-		ShardId:           aws.String(string(shard)),
-		StreamName:        aws.String(p.Name),
-		ShardIteratorType: aws.String("LATEST"),
+// getRecords reads the shard until it has caught up with the tip of the shard, or until maxReadsPerShard
+// requests have been made. If the shard was read too recently to be read again, e.g. by the previous call
+// to Get, nothing is read, so the shard keeps its position until the next call. Between the requests made
+// to catch up, getRecords waits for the shard's read limit, unless the wait would go past the context's
+// deadline. Throttled requests are retried, and if the shard is still throttled, the records read so far
+// are returned. If the shard is closed and has been read to the end, ended is true. The next iterator is
+// kept for the next call, if it reads from the same position. If the context is done, the records read so
+// far are returned with the context's error.
+func (p Stream) getRecords(ctx context.Context, sr shardRead, b *backlog) (records []*kinesis.Record, to SequenceNumber, read, ended bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
 	}
-	if string(from) != "" {
-		gsii.ShardIteratorType = aws.String("AFTER_SEQUENCE_NUMBER")
-		gsii.StartingSequenceNumber = aws.String(string(from))
+	if !p.limiter.reserve(sr.shard) {
+		// Waiting would hold up the caller, e.g. a changes.Observer, which holds its lock while reading.
+		return
 	}
-
-	var itr *kinesis.GetShardIteratorOutput
-	itr, err = p.svc.GetShardIterator(gsii)
+	reserved := true
+	iterator, err := p.getIterator(ctx, sr, true)
 	if err != nil {
-		err = fmt.Errorf("Get: failed to get iterator: %v", err)
 		return
 	}
+	defer func() {
+		if err != nil || ended {
+			p.iterators.set(sr.shard, "", nil)
+			return
+		}
+		if read {
+			p.iterators.set(sr.shard, to, iterator)
+			return
+		}
+		p.iterators.set(sr.shard, sr.from, iterator)
+	}()
 
-	for itr.ShardIterator != nil {
+	for reads := 0; iterator != nil && reads < p.maxReadsPerShard; reads++ {
 		var gro *kinesis.GetRecordsOutput
-		gro, err = p.svc.GetRecords(&kinesis.GetRecordsInput{ShardIterator: itr.ShardIterator})
-		if err != nil {
-			err = fmt.Errorf("Get: failed to get records for shard '%v' with shard iterator type '%v' (from '%v'): %v", shard, gsii.ShardIteratorType, from, err)
+		err = p.retryThrottled(ctx, func() (err error) {
+			if !reserved {
+				if err = p.limiter.wait(ctx, sr.shard); err != nil {
+					return
+				}
+			}
+			reserved = false
+			gro, err = p.svc.GetRecordsWithContext(ctx, &kinesis.GetRecordsInput{ShardIterator: iterator})
+			return
+		})
+		if ctx.Err() != nil {
+			err = ctx.Err()
 			return
 		}
-		if len(gro.Records) == 0 {
+		if err == errNotDue {
+			// Carry on from here next time.
+			err = nil
 			break
 		}
+		if aerr, isAWSError := err.(awserr.Error); isAWSError && aerr.Code() == kinesis.ErrCodeExpiredIteratorException {
+			// Start again from the last record read.
+			next := sr
+			if read {
+				next.from = to
+			}
+			if iterator, err = p.getIterator(ctx, next, false); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if aerr, isAWSError := err.(awserr.Error); isAWSError && isThrottled(aerr.Code()) {
+				// Carry on from here next time.
+				err = nil
+				break
+			}
+			err = fmt.Errorf("Get: failed to get records for shard '%v' with shard iterator type '%v' (from '%v'): %v", sr.shard, sr.iteratorType(), sr.from, err)
+			return
+		}
+		var size int64
 		for _, r := range gro.Records {
 			records = append(records, r)
 			to = SequenceNumber(*r.SequenceNumber)
 			read = true
+			size += int64(len(r.Data))
+		}
+		iterator = gro.NextShardIterator
+		behind := time.Duration(aws.Int64Value(gro.MillisBehindLatest)) * time.Millisecond
+		p.lag.set(sr.shard, behind)
+		if err = b.add(int64(len(gro.Records)), size, behind); err != nil {
+			return
+		}
+		// The iterator of a closed shard is nil once the last record has been read.
+		if sr.closed && iterator == nil {
+			ended = true
+			p.lag.remove(sr.shard)
+			break
+		}
+		// Kinesis can return empty batches when the reader is behind, so keep reading until it has caught up,
+		// but no further, since each read counts towards the shard's read limit.
+		if behind == 0 {
+			break
 		}
-		itr.ShardIterator = gro.NextShardIterator
 	}
 	return
 }
 
+// getIterator returns an iterator which reads the shard from the position. If useCache is true, the
+// iterator left by the last read from the same position is used.
+func (p Stream) getIterator(ctx context.Context, sr shardRead, useCache bool) (iterator *string, err error) {
+	if useCache {
+		if cached, ok := p.iterators.get(sr.shard, sr.from); ok {
+			return aws.String(cached), nil
+		}
+	}
+	gsii := &kinesis.GetShardIteratorInput{
+		ShardId:           aws.String(string(sr.shard)),
+		StreamName:        aws.String(p.Name),
+		ShardIteratorType: aws.String(sr.iteratorType()),
+	}
+	switch *gsii.ShardIteratorType {
+	case kinesis.ShardIteratorTypeAfterSequenceNumber:
+		gsii.StartingSequenceNumber = aws.String(string(sr.from))
+	case kinesis.ShardIteratorTypeAtTimestamp:
+		t, _ := sr.from.timestamp()
+		gsii.Timestamp = aws.Time(t)
+	}
+	var itr *kinesis.GetShardIteratorOutput
+	err = p.retryThrottled(ctx, func() (err error) {
+		itr, err = p.svc.GetShardIteratorWithContext(ctx, gsii)
+		return
+	})
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return
+	}
+	if aerr, isAWSError := err.(awserr.Error); isAWSError && aerr.Code() == kinesis.ErrCodeInvalidArgumentException && gsii.StartingSequenceNumber != nil {
+		// The sequence number is older than the stream's retention period.
+		err = &PositionExpiredError{Shard: sr.shard, Position: sr.from, Err: err}
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("Get: failed to get iterator: %v", err)
+		return
+	}
+	iterator = itr.ShardIterator
+	return
+}
+
+// retryThrottled calls f, retrying with jittered exponential backoff if the request is throttled.
+func (p Stream) retryThrottled(ctx context.Context, f func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || attempt >= p.getRetry.attempts {
+			return
+		}
+		if aerr, isAWSError := err.(awserr.Error); !isAWSError || !isThrottled(aerr.Code()) {
+			return
+		}
+		if waitErr := p.getRetry.wait(ctx, attempt-1); waitErr != nil {
+			return waitErr
+		}
+	}
+}
+
+// Lag returns how far behind the tip of each shard the last read was. A shard which is continually behind
+// is receiving records faster than they're being read.
+func (p Stream) Lag() map[ShardID]time.Duration {
+	return p.lag.get()
+}
+
 func getDataFromRecords(records []*kinesis.Record) (data []StreamData, err error) {
 	for _, r := range records {
 		var sd StreamData
@@ -1,12 +1,20 @@
 package expiry
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"testing/quick"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
@@ -15,18 +23,23 @@ type TestKinesisStream struct {
 	ListShardsFunc       func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error)
 	GetShardIteratorFunc func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error)
 	GetRecordsFunc       func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
+	// GetRecordsContextFunc is used instead of GetRecordsFunc, if set.
+	GetRecordsContextFunc func(ctx aws.Context, input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
 }
 
-func (tks TestKinesisStream) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+func (tks TestKinesisStream) PutRecordsWithContext(ctx aws.Context, input *kinesis.PutRecordsInput, opts ...request.Option) (*kinesis.PutRecordsOutput, error) {
 	return tks.PutRecordsFunc(input)
 }
-func (tks TestKinesisStream) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+func (tks TestKinesisStream) ListShardsWithContext(ctx aws.Context, input *kinesis.ListShardsInput, opts ...request.Option) (*kinesis.ListShardsOutput, error) {
 	return tks.ListShardsFunc(input)
 }
-func (tks TestKinesisStream) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+func (tks TestKinesisStream) GetShardIteratorWithContext(ctx aws.Context, input *kinesis.GetShardIteratorInput, opts ...request.Option) (*kinesis.GetShardIteratorOutput, error) {
 	return tks.GetShardIteratorFunc(input)
 }
-func (tks TestKinesisStream) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+func (tks TestKinesisStream) GetRecordsWithContext(ctx aws.Context, input *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	if tks.GetRecordsContextFunc != nil {
+		return tks.GetRecordsContextFunc(ctx, input)
+	}
 	return tks.GetRecordsFunc(input)
 }
 
@@ -70,10 +83,14 @@ func TestListShards(t *testing.T) {
 	s.svc = TestKinesisStream{
 		ListShardsFunc: DefaultListShardsFunc,
 	}
-	ids, err := s.listShards()
+	shards, err := s.listShards(context.Background())
 	if err != nil {
 		t.Errorf("unexepected error listing shards: %v", err)
 	}
+	var ids []ShardID
+	for _, shard := range shards {
+		ids = append(ids, ShardID(*shard.ShardId))
+	}
 	if !reflect.DeepEqual(ids, []ShardID{"shard_1", "shard_2", "shard_3", "shard_4"}) {
 		t.Errorf("unexpected list of shards: %v", ids)
 	}
@@ -161,7 +178,7 @@ func TestGetRecords(t *testing.T) {
 			GetShardIteratorFunc: test.getShardIteratorFunc,
 			GetRecordsFunc:       test.getRecordsFunc,
 		}
-		records, to, read, err := s.getRecords("shard_1", test.from)
+		records, to, read, _, err := s.getRecords(context.Background(), shardRead{shard: "shard_1", from: test.from}, nil)
 		if err != nil {
 			t.Fatalf("%s: unexpected error getting records: %v", test.name, err)
 		}
@@ -304,6 +321,82 @@ func TestGet(t *testing.T) {
 			},
 			expectedIDs: []string{"sequence_1_1", "sequence_1_2", "sequence_1_3", "sequence_2_1", "sequence_2_2", "sequence_2_3", "sequence_2_4", "sequence_2_5", "sequence_2_6"},
 		},
+		{
+			name: "duplicate records are ignored",
+			listShardsFunc: func(input *kinesis.ListShardsInput) (op *kinesis.ListShardsOutput, err error) {
+				op = &kinesis.ListShardsOutput{
+					Shards: []*kinesis.Shard{
+						{
+							ShardId: aws.String("shard_1"),
+						},
+					},
+				}
+				return
+			},
+			getShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+				return &kinesis.GetShardIteratorOutput{
+					ShardIterator: aws.String("shard_iterator_1"),
+				}, nil
+			},
+			getRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+				return &kinesis.GetRecordsOutput{
+					Records: []*kinesis.Record{
+						{
+							SequenceNumber: aws.String("sequence_1"),
+							Data:           []byte(`{ "id": "message_1/0", "keys": ["key_1"], "ts": "2018-06-11T14:00:00.000Z" }`),
+						},
+						{
+							SequenceNumber: aws.String("sequence_2"),
+							Data:           []byte(`{ "id": "message_1/1", "keys": ["key_2"], "ts": "2018-06-11T14:00:00.000Z" }`),
+						},
+						{
+							SequenceNumber: aws.String("sequence_3"),
+							Data:           []byte(`{ "id": "message_1/0", "keys": ["key_1"], "ts": "2018-06-11T14:00:00.000Z" }`),
+						},
+					},
+				}, nil
+			},
+			expectedTo: map[ShardID]SequenceNumber{
+				ShardID("shard_1"): SequenceNumber("sequence_3"),
+			},
+			expectedIDs: []string{"key_1", "key_2"},
+		},
+		{
+			name: "records written for the reader are skipped",
+			listShardsFunc: func(input *kinesis.ListShardsInput) (op *kinesis.ListShardsOutput, err error) {
+				op = &kinesis.ListShardsOutput{
+					Shards: []*kinesis.Shard{
+						{
+							ShardId: aws.String("shard_1"),
+						},
+					},
+				}
+				return
+			},
+			getShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+				return &kinesis.GetShardIteratorOutput{
+					ShardIterator: aws.String("shard_iterator_1"),
+				}, nil
+			},
+			getRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+				return &kinesis.GetRecordsOutput{
+					Records: []*kinesis.Record{
+						{
+							SequenceNumber: aws.String("sequence_1"),
+							Data:           []byte(`{ "id": "message_1/0", "producer": "other", "keys": ["key_1"], "ts": "2018-06-11T14:00:00.000Z" }`),
+						},
+						{
+							SequenceNumber: aws.String("sequence_2"),
+							Data:           []byte(`{ "id": "message_2/0", "producer": "reader", "keys": ["key_2"], "ts": "2018-06-11T14:00:00.000Z" }`),
+						},
+					},
+				}, nil
+			},
+			expectedTo: map[ShardID]SequenceNumber{
+				ShardID("shard_1"): SequenceNumber("sequence_2"),
+			},
+			expectedIDs: []string{"key_1"},
+		},
 	}
 
 	for _, test := range tests {
@@ -313,7 +406,7 @@ func TestGet(t *testing.T) {
 			GetShardIteratorFunc: test.getShardIteratorFunc,
 			GetRecordsFunc:       test.getRecordsFunc,
 		}
-		ids, to, err := s.Get(test.from)
+		ids, to, err := s.GetFor(context.Background(), "reader", test.from)
 		if err != nil {
 			t.Fatalf("%s: unexpected error getting records: %v", test.name, err)
 		}
@@ -328,6 +421,26 @@ func TestGet(t *testing.T) {
 
 func TestPut(t *testing.T) {
 	var putRecordsCallCount, recordsAdded, itemsInRecords int
+	// Each record contains JSON encoded keys, the record ID, timestamp and partition key.
+	overhead := recordOverhead(createRandomKey(), "")
+	countRecords := func(input *kinesis.PutRecordsInput) (op *kinesis.PutRecordsOutput, err error) {
+		putRecordsCallCount++
+		recordsAdded += len(input.Records)
+		for _, r := range input.Records {
+			var data StreamData
+			err := json.Unmarshal(r.Data, &data)
+			if err != nil {
+				t.Errorf("put records: unexpected error unmarhsalling data received by putRecords: %v", err)
+				break
+			}
+			itemsInRecords += len(data.Keys)
+		}
+		return &kinesis.PutRecordsOutput{}, err
+	}
+	manyIDs := make([]string, 501)
+	for i := range manyIDs {
+		manyIDs[i] = "12345"
+	}
 	tests := []struct {
 		name                     string
 		maxPutSize               int
@@ -341,7 +454,7 @@ func TestPut(t *testing.T) {
 	}{
 		{
 			name:          "put records",
-			maxRecordSize: 10, // bytes
+			maxRecordSize: overhead + len(`"12345","67890"`),
 			putRecordsFunc: func(input *kinesis.PutRecordsInput) (op *kinesis.PutRecordsOutput, err error) {
 				putRecordsCallCount++
 				recordsAdded += len(input.Records)
@@ -357,14 +470,14 @@ func TestPut(t *testing.T) {
 				return &kinesis.PutRecordsOutput{}, err
 			},
 			ids: []string{"12345", "67890", "12345"},
-			expectedPutRecordsCalled: 1, // The call is below the default 2MB of data to PUT data, so only one call is expected.
-			expectedRecordsAdded:     2, // Because the maxRecordSize is 10, { 12345, 67890 } should be in one record and { 123456 } in another.
+			expectedPutRecordsCalled: 1, // The call is below the default 5MB of data to PUT data, so only one call is expected.
+			expectedRecordsAdded:     2, // Because the maxRecordSize only has room for two keys, { 12345, 67890 } should be in one record and { 123456 } in another.
 			expectedKeysInRecords:    3, // 3 IDs should have been added to the stream.
 		},
 		{
 			name:          "put record, need to make 2 calls due to limits on put size",
-			maxPutSize:    10,
-			maxRecordSize: 10, // bytes
+			maxPutSize:    overhead + len(`"12345","67890"`),
+			maxRecordSize: overhead + len(`"12345","67890"`),
 			putRecordsFunc: func(input *kinesis.PutRecordsInput) (op *kinesis.PutRecordsOutput, err error) {
 				putRecordsCallCount++
 				recordsAdded += len(input.Records)
@@ -380,10 +493,32 @@ func TestPut(t *testing.T) {
 				return &kinesis.PutRecordsOutput{}, err
 			},
 			ids: []string{"12345", "67890", "12345"},
-			expectedPutRecordsCalled: 2, // The call is below the default 2MB of data to PUT data, so only one call is expected.
-			expectedRecordsAdded:     2, // Because the maxRecordSize is 10, { 12345, 67890 } should be in one record and { 123456 } in another.
+			expectedPutRecordsCalled: 2, // Only one record fits into each request.
+			expectedRecordsAdded:     2, // Because the maxRecordSize only has room for two keys, { 12345, 67890 } should be in one record and { 123456 } in another.
 			expectedKeysInRecords:    3, // 3 IDs should have been added to the stream.
 		},
+		{
+			name:                     "put records, need to make 2 calls due to limits on the number of records",
+			maxRecordSize:            overhead + len(`"12345"`),
+			putRecordsFunc:           countRecords,
+			ids:                      manyIDs,
+			expectedPutRecordsCalled: 2, // Kinesis allows 500 records per request.
+			expectedRecordsAdded:     501,
+			expectedKeysInRecords:    501,
+		},
+		{
+			name:           "keys which are too large for a record are not sent",
+			maxRecordSize:  overhead + len(`"12345"`),
+			putRecordsFunc: countRecords,
+			ids:            []string{"12345", "1234567890"},
+			expectedErr: &PutError{
+				Keys: []string{"1234567890"},
+				Err:  ErrRecordTooLarge,
+			},
+			expectedPutRecordsCalled: 1,
+			expectedRecordsAdded:     1,
+			expectedKeysInRecords:    1,
+		},
 	}
 
 	for _, test := range tests {
@@ -399,7 +534,7 @@ func TestPut(t *testing.T) {
 		if test.maxPutSize > 0 {
 			s.maxPutSize = test.maxPutSize
 		}
-		err := s.Put(test.ids)
+		err := s.Put(context.Background(), test.ids)
 		if !reflect.DeepEqual(err, test.expectedErr) {
 			t.Errorf("%s: expected error '%v', got '%v'", test.name, test.expectedErr, err)
 		}
@@ -418,44 +553,702 @@ func TestPut(t *testing.T) {
 	}
 }
 
-func TestChunk(t *testing.T) {
+func TestPutRetries(t *testing.T) {
+	keysIn := func(input *kinesis.PutRecordsInput) (keys []string) {
+		for _, r := range input.Records {
+			var data StreamData
+			if err := json.Unmarshal(r.Data, &data); err != nil {
+				t.Fatalf("unexpected error unmarshalling data received by putRecords: %v", err)
+			}
+			keys = append(keys, data.Keys...)
+		}
+		return
+	}
+	throttled := func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+		return nil, awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	}
+	// failSecondRecord fails the second record in the request, if there is more than one.
+	failSecondRecord := func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+		op := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+		for i := range input.Records {
+			if i == 1 {
+				op.FailedRecordCount = aws.Int64(1)
+				op.Records = append(op.Records, &kinesis.PutRecordsResultEntry{
+					ErrorCode:    aws.String(kinesis.ErrCodeProvisionedThroughputExceededException),
+					ErrorMessage: aws.String("slow down"),
+				})
+				continue
+			}
+			op.Records = append(op.Records, &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("1")})
+		}
+		return op, nil
+	}
+	succeed := func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+		return &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}, nil
+	}
 	tests := []struct {
-		input    []string
-		size     int
-		expected [][]string
+		name                string
+		putRecordsFuncs     []func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+		expectedKeysPerCall [][]string
+		expectedFailedKeys  []string
 	}{
 		{
+			name:                "failed records are retried",
+			putRecordsFuncs:     []func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error){failSecondRecord, failSecondRecord},
+			expectedKeysPerCall: [][]string{{"12345", "67890", "abcde"}, {"67890"}},
+		},
+		{
+			name:                "throttled requests are retried",
+			putRecordsFuncs:     []func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error){throttled, succeed},
+			expectedKeysPerCall: [][]string{{"12345", "67890", "abcde"}, {"12345", "67890", "abcde"}},
+		},
+		{
+			name: "keys which can't be written are returned in the error",
+			putRecordsFuncs: []func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error){
+				failSecondRecord, throttled, throttled,
+			},
+			expectedKeysPerCall: [][]string{{"12345", "67890", "abcde"}, {"67890"}, {"67890"}},
+			expectedFailedKeys:  []string{"67890"},
+		},
+	}
+
+	for _, test := range tests {
+		var keysPerCall [][]string
+		var waits int
+		s := NewStream("test")
+		s.maxRecordSize = recordOverhead(createRandomKey(), "") + len(`"12345"`)
+		s.putRetry.attempts = 3
+		s.putRetry.sleep = func(ctx context.Context, d time.Duration) error {
+			if d > s.putRetry.max {
+				t.Errorf("%s: waited for %v, which is longer than the maximum", test.name, d)
+			}
+			waits++
+			return nil
+		}
+		s.svc = TestKinesisStream{
+			PutRecordsFunc: func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+				call := len(keysPerCall)
+				keysPerCall = append(keysPerCall, keysIn(input))
+				if call >= len(test.putRecordsFuncs) {
+					t.Fatalf("%s: unexpected call to PutRecords", test.name)
+				}
+				return test.putRecordsFuncs[call](input)
+			},
+		}
+		err := s.Put(context.Background(), []string{"12345", "67890", "abcde"})
+		if !reflect.DeepEqual(keysPerCall, test.expectedKeysPerCall) {
+			t.Errorf("%s: expected keys %v to be put, got %v", test.name, test.expectedKeysPerCall, keysPerCall)
+		}
+		if waits != len(keysPerCall)-1 {
+			t.Errorf("%s: expected to wait before each retry, but waited %d times for %d calls", test.name, waits, len(keysPerCall))
+		}
+		if test.expectedFailedKeys == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		pe, ok := err.(*PutError)
+		if !ok {
+			t.Fatalf("%s: expected *PutError, got %v", test.name, err)
+		}
+		if !reflect.DeepEqual(pe.Keys, test.expectedFailedKeys) {
+			t.Errorf("%s: expected failed keys %v, got %v", test.name, test.expectedFailedKeys, pe.Keys)
+		}
+	}
+}
+
+func TestCreatePutRecords(t *testing.T) {
+	overhead := recordOverhead("id", "producer")
+	tests := []struct {
+		name             string
+		input            []string
+		size             int
+		expected         [][]string
+		expectedTooLarge []string
+	}{
+		{
+			name:     "one key per record",
 			input:    []string{"A", "B", "C"},
-			size:     1,
+			size:     overhead + len(`"A"`),
 			expected: [][]string{{"A"}, {"B"}, {"C"}},
 		},
 		{
+			name:     "two keys per record",
 			input:    []string{"A", "B", "C"},
-			size:     2,
+			size:     overhead + len(`"A","B"`),
 			expected: [][]string{{"A", "B"}, {"C"}},
 		},
 		{
+			name:     "all keys in one record",
 			input:    []string{"A", "B", "C"},
-			size:     3,
+			size:     overhead + 200,
 			expected: [][]string{{"A", "B", "C"}},
 		},
 		{
-			input:    []string{"A", "B", "C"},
-			size:     200,
-			expected: [][]string{{"A", "B", "C"}},
+			name:     "escaped characters are included in the size",
+			input:    []string{"<>", "&"},
+			size:     overhead + len(`"\u003c\u003e"`),
+			expected: [][]string{{"<>"}, {"&"}},
 		},
 		{
-			input:    []string{"12345", "67890", "12345"},
-			size:     10,
-			expected: [][]string{{"12345", "67890"}, {"12345"}},
+			name:             "keys too large for a record",
+			input:            []string{"A", "BBBBBBBB", "C"},
+			size:             overhead + len(`"A","C"`),
+			expected:         [][]string{{"A", "C"}},
+			expectedTooLarge: []string{"BBBBBBBB"},
 		},
 	}
 
 	for _, test := range tests {
-		actual := chunk(test.input, test.size)
+		records, actual, tooLarge, err := createPutRecords("id", "producer", test.input, test.size)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
 		if !reflect.DeepEqual(test.expected, actual) {
-			t.Errorf("for input '%v' and chunk size %d, expected '%v', got '%v'", test.input, test.size,
-				test.expected, actual)
+			t.Errorf("%s: expected '%v', got '%v'", test.name, test.expected, actual)
+		}
+		if !reflect.DeepEqual(test.expectedTooLarge, tooLarge) {
+			t.Errorf("%s: expected too large keys '%v', got '%v'", test.name, test.expectedTooLarge, tooLarge)
+		}
+		for i, r := range records {
+			var sd StreamData
+			if err = json.Unmarshal(r.Data, &sd); err != nil {
+				t.Fatalf("%s: unexpected error unmarshalling record %d: %v", test.name, i, err)
+			}
+			if sd.ID != recordID("id", i) {
+				t.Errorf("%s: expected record ID '%v', got '%v'", test.name, recordID("id", i), sd.ID)
+			}
+			if sd.Producer != "producer" {
+				t.Errorf("%s: expected producer 'producer', got '%v'", test.name, sd.Producer)
+			}
 		}
 	}
 }
+
+// TestPutLimits checks that Kinesis limits are never exceeded, and that every key is sent exactly once.
+func TestPutLimits(t *testing.T) {
+	overhead := recordOverhead(createRandomKey(), "")
+	property := func(keys []string, extraRecordSize uint16, extraPutSize uint32, maxPutRecords uint16) bool {
+		s := NewStream("test")
+		s.maxRecordSize = overhead + int(extraRecordSize)
+		s.maxPutSize = overhead + int(extraPutSize)
+		s.maxPutRecords = int(maxPutRecords%600) + 1
+		var sent, tooLarge []string
+		s.svc = TestKinesisStream{
+			PutRecordsFunc: func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+				var requestSize int
+				if len(input.Records) > s.maxPutRecords || len(input.Records) > kinesisMaxPutRecords {
+					t.Errorf("request contains %d records, the limit is %d", len(input.Records), s.maxPutRecords)
+				}
+				for _, r := range input.Records {
+					size := recordSize(r)
+					if size > s.maxRecordSize || size > kinesisMaxRecordSize {
+						t.Errorf("record of %d bytes exceeds the limit of %d", size, s.maxRecordSize)
+					}
+					requestSize += size
+					var sd StreamData
+					if err := json.Unmarshal(r.Data, &sd); err != nil {
+						t.Fatalf("unexpected error unmarshalling record: %v", err)
+					}
+					sent = append(sent, sd.Keys...)
+				}
+				if requestSize > s.maxPutSize || requestSize > kinesisMaxPutSize {
+					t.Errorf("request of %d bytes exceeds the limit of %d", requestSize, s.maxPutSize)
+				}
+				return &kinesis.PutRecordsOutput{}, nil
+			},
+		}
+		if err := s.Put(context.Background(), keys); err != nil {
+			pe, ok := err.(*PutError)
+			if !ok || pe.Err != ErrRecordTooLarge {
+				t.Errorf("unexpected error: %v", err)
+				return false
+			}
+			tooLarge = pe.Keys
+		}
+		var expectedSent, expectedTooLarge []string
+		for _, k := range keys {
+			encoded, _ := json.Marshal(k)
+			if overhead+len(encoded) > smallest(s.maxRecordSize, s.maxPutSize) {
+				expectedTooLarge = append(expectedTooLarge, k)
+				continue
+			}
+			expectedSent = append(expectedSent, k)
+		}
+		return reflect.DeepEqual(sent, expectedSent) && reflect.DeepEqual(tooLarge, expectedTooLarge)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBatchRecords(t *testing.T) {
+	records := make([]*kinesis.PutRecordsRequestEntry, 1200)
+	for i := range records {
+		records[i] = &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String(createRandomKey()),
+			Data:         make([]byte, 1024*1024-partitionKeyLength),
+		}
+	}
+	actual := batchRecords(records[:12], kinesisMaxPutRecords, kinesisMaxPutSize)
+	expected := []span{{0, 5}, {5, 10}, {10, 12}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("1MB records: expected %v, got %v", expected, actual)
+	}
+	for _, r := range records {
+		r.Data = []byte("{}")
+	}
+	actual = batchRecords(records, kinesisMaxPutRecords, kinesisMaxPutSize)
+	expected = []span{{0, 500}, {500, 1000}, {1000, 1200}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("small records: expected %v, got %v", expected, actual)
+	}
+}
+
+func TestRecentIDs(t *testing.T) {
+	r := newRecentIDs(2)
+	if r.seen("a") || r.seen("b") {
+		t.Fatal("expected new IDs not to have been seen")
+	}
+	if !r.seen("a") {
+		t.Error("expected 'a' to have been seen")
+	}
+	// Adding 'c' removes the oldest ID, 'a'.
+	r.seen("c")
+	if r.seen("a") {
+		t.Error("expected 'a' to have been forgotten")
+	}
+}
+
+func TestDuplicatesAreIgnoredByEachReaderSeparately(t *testing.T) {
+	s := NewStream("test")
+	s.limiter = nil
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{{ShardId: aws.String("shard_1")}}}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			// The message was sent twice, e.g. by an outbox relay.
+			return &kinesis.GetRecordsOutput{
+				Records: []*kinesis.Record{
+					{SequenceNumber: aws.String("1"), Data: []byte(`{ "id": "message_1/0", "keys": ["a"] }`)},
+					{SequenceNumber: aws.String("2"), Data: []byte(`{ "id": "message_1/0", "keys": ["a"] }`)},
+				},
+			}, nil
+		},
+	}
+
+	for _, reader := range []string{"reader_1", "reader_2"} {
+		keys, _, err := s.GetFor(context.Background(), reader, StreamPosition{"shard_1": "0"})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", reader, err)
+		}
+		if !reflect.DeepEqual(keys, []string{"a"}) {
+			t.Errorf("%s: expected the record to be read once, got %v", reader, keys)
+		}
+	}
+}
+
+func TestRecordsAreOnlySkippedByTheirProducer(t *testing.T) {
+	var written [][]byte
+	s := NewStream("test")
+	s.limiter = nil
+	s.svc = TestKinesisStream{
+		PutRecordsFunc: func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+			op := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+			for _, r := range input.Records {
+				written = append(written, r.Data)
+				op.Records = append(op.Records, &kinesis.PutRecordsResultEntry{})
+			}
+			return op, nil
+		},
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{{ShardId: aws.String("shard_1")}}}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			op := &kinesis.GetRecordsOutput{}
+			for i, d := range written {
+				op.Records = append(op.Records, &kinesis.Record{SequenceNumber: aws.String(strconv.Itoa(i + 1)), Data: d})
+			}
+			return op, nil
+		},
+	}
+
+	// Two engines share the Stream.
+	if err := s.PutFrom(context.Background(), "engine_1", []string{"a"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for reader, expected := range map[string][]string{"engine_1": nil, "engine_2": {"a"}} {
+		keys, to, err := s.GetFor(context.Background(), reader, StreamPosition{"shard_1": "0"})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", reader, err)
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("%s: expected keys %v, got %v", reader, expected, keys)
+		}
+		if to["shard_1"] != "1" {
+			t.Errorf("%s: expected the position to move past the record, got %v", reader, to)
+		}
+	}
+}
+
+func TestGetReadsShardsConcurrently(t *testing.T) {
+	var shards []*kinesis.Shard
+	for i := 0; i < 20; i++ {
+		shards = append(shards, &kinesis.Shard{ShardId: aws.String(fmt.Sprintf("shard_%02d", i))})
+	}
+	var mutex sync.Mutex
+	var running, maxRunning int
+	s := NewStream("test")
+	s.maxConcurrentShards = 4
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: shards}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{ShardIterator: input.ShardId}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			time.Sleep(time.Millisecond * 10)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			shard := *input.ShardIterator
+			if shard == "shard_05" {
+				// No new records.
+				return &kinesis.GetRecordsOutput{}, nil
+			}
+			return &kinesis.GetRecordsOutput{
+				Records: []*kinesis.Record{
+					{
+						SequenceNumber: aws.String(shard + "_sequence"),
+						Data:           []byte(`{ "keys": ["` + shard + `"], "ts": "2018-06-11T14:00:00.000Z" }`),
+					},
+				},
+			}, nil
+		},
+	}
+	from := StreamPosition{}
+	for _, shard := range shards {
+		from[ShardID(*shard.ShardId)] = SequenceNumber(*shard.ShardId + "_previous")
+	}
+
+	keys, to, err := s.Get(context.Background(), from)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if maxRunning > 4 {
+		t.Errorf("expected at most 4 shards to be read at once, but %d were", maxRunning)
+	}
+	if maxRunning < 2 {
+		t.Errorf("expected shards to be read concurrently, but only %d was read at once", maxRunning)
+	}
+	var expectedKeys []string
+	for _, shard := range shards {
+		if *shard.ShardId != "shard_05" {
+			expectedKeys = append(expectedKeys, *shard.ShardId)
+		}
+	}
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("expected keys in shard order %v, got %v", expectedKeys, keys)
+	}
+	if len(to) != len(shards) {
+		t.Errorf("expected a position for all %d shards, got %d", len(shards), len(to))
+	}
+	if to["shard_05"] != "shard_05_previous" {
+		t.Errorf("expected the shard with no new records to keep its position, got '%v'", to["shard_05"])
+	}
+	if to["shard_06"] != "shard_06_sequence" {
+		t.Errorf("expected the shard position to move to the last record, got '%v'", to["shard_06"])
+	}
+}
+
+func TestGetStopsReadingShardsAfterAnError(t *testing.T) {
+	var shards []*kinesis.Shard
+	for i := 0; i < 20; i++ {
+		shards = append(shards, &kinesis.Shard{ShardId: aws.String(fmt.Sprintf("shard_%02d", i))})
+	}
+	var mutex sync.Mutex
+	var started int
+	s := NewStream("test")
+	s.maxConcurrentShards = 2
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: shards}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			mutex.Lock()
+			started++
+			mutex.Unlock()
+			return nil, errors.New("network error")
+		},
+	}
+
+	_, _, err := s.Get(context.Background(), StreamPosition{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if started >= len(shards) {
+		t.Errorf("expected reading to stop after the first error, but %d shards were started", started)
+	}
+}
+
+func TestGetCancelsShardsBeingReadAfterAnError(t *testing.T) {
+	inFlight := make(chan struct{})
+	var cancelled bool
+	s := NewStream("test")
+	s.maxConcurrentShards = 2
+	s.limiter = nil
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{
+				{ShardId: aws.String("shard_1")},
+				{ShardId: aws.String("shard_2")},
+			}}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			if *input.ShardId == "shard_2" {
+				// Fail once the first shard is being read.
+				<-inFlight
+				return nil, errors.New("network error")
+			}
+			return &kinesis.GetShardIteratorOutput{ShardIterator: input.ShardId}, nil
+		},
+		GetRecordsContextFunc: func(ctx aws.Context, input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			close(inFlight)
+			select {
+			case <-ctx.Done():
+				cancelled = true
+				return nil, errors.New("RequestCanceled")
+			case <-time.After(time.Second * 5):
+				return &kinesis.GetRecordsOutput{}, nil
+			}
+		},
+	}
+
+	_, _, err := s.Get(context.Background(), StreamPosition{"shard_1": "100", "shard_2": "200"})
+
+	if err == nil || err == context.Canceled {
+		t.Errorf("expected the shard's error, got %v", err)
+	}
+	if !cancelled {
+		t.Error("expected the shard being read to be cancelled")
+	}
+}
+
+func TestGetRecordsCatchesUpWhenBehind(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxReads         int
+		expectedRecords  int
+		expectedRequests int
+		expectedLag      time.Duration
+	}{
+		{
+			name:             "empty batches are skipped until the reader catches up",
+			maxReads:         10,
+			expectedRecords:  2,
+			expectedRequests: 3,
+			expectedLag:      0,
+		},
+		{
+			name:             "reading stops when the budget is used up",
+			maxReads:         2,
+			expectedRecords:  1,
+			expectedRequests: 2,
+			expectedLag:      time.Second * 5,
+		},
+	}
+
+	for _, test := range tests {
+		// Kinesis returns an empty batch while behind the tip of the shard.
+		batches := []*kinesis.GetRecordsOutput{
+			{Records: []*kinesis.Record{{SequenceNumber: aws.String("1"), Data: []byte(`{}`)}}, MillisBehindLatest: aws.Int64(10000)},
+			{MillisBehindLatest: aws.Int64(5000)},
+			{Records: []*kinesis.Record{{SequenceNumber: aws.String("2"), Data: []byte(`{}`)}}, MillisBehindLatest: aws.Int64(0)},
+			{MillisBehindLatest: aws.Int64(0)},
+		}
+		var requests int
+		s := NewStream("test")
+		s.limiter = nil
+		s.maxReadsPerShard = test.maxReads
+		s.svc = TestKinesisStream{
+			GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+				return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+			},
+			GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+				op := batches[requests]
+				op.NextShardIterator = aws.String("iterator")
+				requests++
+				return op, nil
+			},
+		}
+		records, _, _, _, err := s.getRecords(context.Background(), shardRead{shard: "shard_1", from: "0"}, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if len(records) != test.expectedRecords {
+			t.Errorf("%s: expected %d records, got %d", test.name, test.expectedRecords, len(records))
+		}
+		if requests != test.expectedRequests {
+			t.Errorf("%s: expected %d requests, got %d", test.name, test.expectedRequests, requests)
+		}
+		if lag := s.Lag()["shard_1"]; lag != test.expectedLag {
+			t.Errorf("%s: expected a lag of %v, got %v", test.name, test.expectedLag, lag)
+		}
+	}
+}
+
+func TestGetRecordsStopsOnceCaughtUp(t *testing.T) {
+	var requests int
+	s := NewStream("test")
+	s.limiter.sleep = func(ctx context.Context, d time.Duration) error {
+		t.Errorf("expected no wait, but waited %v", d)
+		return nil
+	}
+	s.svc = TestKinesisStream{
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			requests++
+			return &kinesis.GetRecordsOutput{
+				Records:            []*kinesis.Record{{SequenceNumber: aws.String("1"), Data: []byte(`{}`)}},
+				NextShardIterator:  aws.String("iterator"),
+				MillisBehindLatest: aws.Int64(0),
+			}, nil
+		},
+	}
+
+	records, _, _, _, err := s.getRecords(context.Background(), shardRead{shard: "shard_1", from: "0"}, nil)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 {
+		t.Errorf("expected 1 record, got %d", len(records))
+	}
+	if requests != 1 {
+		t.Errorf("expected a batch which has caught up to be the last request, got %d requests", requests)
+	}
+}
+
+func TestGetRecordsRetriesThrottledRequests(t *testing.T) {
+	throttled := awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	tests := []struct {
+		name            string
+		responses       []error
+		expectedRecords int
+		expectedErr     bool
+	}{
+		{
+			name:            "throttled requests are retried",
+			responses:       []error{throttled, nil, nil},
+			expectedRecords: 1,
+		},
+		{
+			name:            "records read before the shard is throttled are returned",
+			responses:       []error{nil, throttled, throttled, throttled},
+			expectedRecords: 1,
+		},
+		{
+			name:        "other errors are returned",
+			responses:   []error{errors.New("failed")},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		var requests, sleeps int
+		s := NewStream("test")
+		s.limiter = nil
+		s.getRetry.sleep = func(ctx context.Context, d time.Duration) error {
+			sleeps++
+			return nil
+		}
+		s.svc = TestKinesisStream{
+			GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+				return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+			},
+			GetRecordsFunc: func(input *kinesis.GetRecordsInput) (op *kinesis.GetRecordsOutput, err error) {
+				err = test.responses[requests]
+				requests++
+				if err != nil {
+					return
+				}
+				op = &kinesis.GetRecordsOutput{NextShardIterator: aws.String("iterator")}
+				if requests < len(test.responses) {
+					op.Records = []*kinesis.Record{{SequenceNumber: aws.String("1"), Data: []byte(`{}`)}}
+					op.MillisBehindLatest = aws.Int64(1000)
+				}
+				return
+			},
+		}
+		records, _, _, _, err := s.getRecords(context.Background(), shardRead{shard: "shard_1", from: "0"}, nil)
+		if test.expectedErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expectedErr, err)
+		}
+		if len(records) != test.expectedRecords {
+			t.Errorf("%s: expected %d records, got %d", test.name, test.expectedRecords, len(records))
+		}
+		if requests != len(test.responses) {
+			t.Errorf("%s: expected %d requests, got %d", test.name, len(test.responses), requests)
+		}
+	}
+}
+
+func TestGetReturnsTheRecordsReadBeforeTheContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var requests int
+	s := NewStream("test")
+	s.limiter = nil
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{{ShardId: aws.String("shard_1")}}}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			requests++
+			if requests > 1 {
+				// The request is cancelled while waiting for the second batch.
+				cancel()
+				return nil, errors.New("RequestCanceled")
+			}
+			return &kinesis.GetRecordsOutput{
+				Records: []*kinesis.Record{
+					{SequenceNumber: aws.String("1"), Data: []byte(`{ "keys": ["a"] }`)},
+				},
+				NextShardIterator:  aws.String("iterator"),
+				MillisBehindLatest: aws.Int64(1000),
+			}, nil
+		},
+	}
+
+	keys, to, err := s.Get(ctx, StreamPosition{"shard_1": "0"})
+	if err != context.Canceled {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("expected the keys read before the context was cancelled, got %v", keys)
+	}
+	if expected := (StreamPosition{"shard_1": "1"}); !reflect.DeepEqual(to, expected) {
+		t.Errorf("expected position %v, got %v", expected, to)
+	}
+}
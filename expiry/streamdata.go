@@ -4,6 +4,12 @@ import "time"
 
 // StreamData is the data stored in each cache invalidation stream.
 type StreamData struct {
+	// ID uniquely identifies the record, so that records which are sent more than once can be ignored.
+	ID string `json:"id,omitempty"`
+	// Producer is the reader ID passed to PutFrom, e.g. the ID of a changes.Observer, so that GetFor skips
+	// the record when it's called with the same reader. The reader's own records no longer evict stale values
+	// cached by concurrent requests on the same instance after the local remove, but before the publish.
+	Producer string `json:"producer,omitempty"`
 	// The data keys which have been invalidated.
 	Keys []string `json:"keys"`
 	// The time that they were invalidated (client-side).
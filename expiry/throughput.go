@@ -0,0 +1,119 @@
+package expiry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// kinesisReadsPerSecond is the maximum number of GetRecords requests per second allowed by Kinesis for each
+// shard.
+const kinesisReadsPerSecond = 5
+
+// defaultMaxReadsPerShard is the default number of GetRecords requests made to each shard by a single Get.
+// Each request returns up to 10,000 records.
+const defaultMaxReadsPerShard = 10
+
+var defaultGetRetry = backoff{
+	attempts: 3,
+	base:     time.Millisecond * 200,
+	max:      time.Second,
+	sleep:    sleepContext,
+}
+
+// shardLimiter spaces out the reads of each shard, so that concurrent calls to Get don't exceed the Kinesis
+// read limit. It's shared by copies of the Stream, but not between processes, so requests can still be
+// throttled when many instances read the stream at once.
+type shardLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     map[ShardID]time.Time
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+func newShardLimiter(readsPerSecond int) *shardLimiter {
+	return &shardLimiter{
+		interval: time.Second / time.Duration(readsPerSecond),
+		next:     make(map[ShardID]time.Time),
+		now:      time.Now,
+		sleep:    sleepContext,
+	}
+}
+
+// errNotDue is returned by shardLimiter.wait when the next read of the shard isn't due before the context's
+// deadline.
+var errNotDue = errors.New("expiry: the next read of the shard isn't due in time")
+
+// reserve reserves the next read of the shard, if it's due now. If it isn't, false is returned, and nothing
+// is reserved.
+func (l *shardLimiter) reserve(shard ShardID) bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	if l.next[shard].After(now) {
+		return false
+	}
+	l.next[shard] = now.Add(l.interval)
+	return true
+}
+
+// wait reserves the next read of the shard, and sleeps until it's due, or the context is done. If the read
+// isn't due before the context's deadline, errNotDue is returned, and nothing is reserved.
+func (l *shardLimiter) wait(ctx context.Context, shard ShardID) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	now := l.now()
+	due := l.next[shard]
+	if due.Before(now) {
+		due = now
+	}
+	if deadline, ok := ctx.Deadline(); ok && due.After(deadline) {
+		l.mutex.Unlock()
+		return errNotDue
+	}
+	l.next[shard] = due.Add(l.interval)
+	l.mutex.Unlock()
+	if d := due.Sub(now); d > 0 {
+		return l.sleep(ctx, d)
+	}
+	return nil
+}
+
+// shardLag records how far behind the tip of each shard the last read was.
+type shardLag struct {
+	mutex sync.Mutex
+	lag   map[ShardID]time.Duration
+}
+
+func newShardLag() *shardLag {
+	return &shardLag{lag: make(map[ShardID]time.Duration)}
+}
+
+func (l *shardLag) set(shard ShardID, lag time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lag[shard] = lag
+}
+
+func (l *shardLag) remove(shard ShardID) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.lag, shard)
+}
+
+func (l *shardLag) get() (lag map[ShardID]time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lag = make(map[ShardID]time.Duration, len(l.lag))
+	for k, v := range l.lag {
+		lag[k] = v
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package expiry
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestShardLimiterSpacesOutReadsOfEachShard(t *testing.T) {
+	now := time.Date(2018, time.June, 11, 14, 0, 0, 0, time.UTC)
+	var mutex sync.Mutex
+	var slept []time.Duration
+	l := newShardLimiter(5)
+	l.now = func() time.Time { return now }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		slept = append(slept, d)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.wait(context.Background(), "shard_1")
+		}()
+	}
+	wg.Wait()
+	l.wait(context.Background(), "shard_2")
+
+	total := time.Duration(0)
+	for _, d := range slept {
+		total += d
+	}
+	if len(slept) != 2 || total != time.Millisecond*600 {
+		t.Errorf("expected the second and third reads of the shard to wait 200ms and 400ms, got %v", slept)
+	}
+
+	// Once the reservations have passed, reads don't wait.
+	now = now.Add(time.Second)
+	slept = nil
+	l.wait(context.Background(), "shard_1")
+	if len(slept) != 0 {
+		t.Errorf("expected no wait, got %v", slept)
+	}
+}
+
+func TestShardLimiterOnlyReservesReadsWhichAreDue(t *testing.T) {
+	now := time.Date(2018, time.June, 11, 14, 0, 0, 0, time.UTC)
+	l := newShardLimiter(5)
+	l.now = func() time.Time { return now }
+
+	if !l.reserve("shard_1") {
+		t.Fatal("expected the first read to be reserved")
+	}
+	if l.reserve("shard_1") {
+		t.Error("expected the second read not to be reserved until it's due")
+	}
+	if !l.reserve("shard_2") {
+		t.Error("expected other shards to be reserved")
+	}
+	now = now.Add(time.Millisecond * 200)
+	if !l.reserve("shard_1") {
+		t.Error("expected the read to be reserved once it's due")
+	}
+}
+
+func TestShardLimiterDoesNotWaitPastTheDeadline(t *testing.T) {
+	now := time.Date(2018, time.June, 11, 14, 0, 0, 0, time.UTC)
+	var slept []time.Duration
+	l := newShardLimiter(5)
+	l.now = func() time.Time { return now }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	l.reserve("shard_1")
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(time.Millisecond*100))
+	defer cancel()
+
+	err := l.wait(ctx, "shard_1")
+
+	if err != errNotDue {
+		t.Errorf("expected errNotDue, got %v", err)
+	}
+	if len(slept) != 0 {
+		t.Errorf("expected no wait, got %v", slept)
+	}
+	if !l.next["shard_1"].Equal(now.Add(time.Millisecond * 200)) {
+		t.Errorf("expected nothing to be reserved, but the next read is due at %v", l.next["shard_1"])
+	}
+}
+
+func TestNilShardLimiterDoesNotWait(t *testing.T) {
+	var l *shardLimiter
+	l.wait(context.Background(), "shard_1")
+	if !l.reserve("shard_1") {
+		t.Error("expected a nil limiter to reserve every read")
+	}
+}
+
+func TestGetSkipsShardsWhichWereReadTooRecently(t *testing.T) {
+	var requests int
+	s := NewStream("test")
+	s.maxReadsPerShard = 1
+	s.limiter.sleep = func(ctx context.Context, d time.Duration) error {
+		t.Errorf("expected no wait, but waited %v", d)
+		return nil
+	}
+	s.svc = TestKinesisStream{
+		ListShardsFunc: func(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+			return &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{{ShardId: aws.String("shard_1")}}}, nil
+		},
+		GetShardIteratorFunc: func(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+			return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String("iterator")}, nil
+		},
+		GetRecordsFunc: func(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+			requests++
+			return &kinesis.GetRecordsOutput{
+				Records:           []*kinesis.Record{{SequenceNumber: aws.String("101"), Data: []byte(`{ "keys": ["a"] }`)}},
+				NextShardIterator: aws.String("iterator"),
+			}, nil
+		},
+	}
+
+	_, to, err := s.Get(context.Background(), StreamPosition{"shard_1": "100"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys, to, err := s.Get(context.Background(), to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if requests != 1 {
+		t.Errorf("expected the shard to be read once, got %d requests", requests)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected no keys from the skipped shard, got %v", keys)
+	}
+	if expected := (StreamPosition{"shard_1": "101"}); !reflect.DeepEqual(to, expected) {
+		t.Errorf("expected the skipped shard to keep its position, got %v", to)
+	}
+}
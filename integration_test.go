@@ -0,0 +1,86 @@
+package scache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/a-h/scache/data"
+	"github.com/a-h/scache/memory"
+)
+
+func TestInvalidationsAreSharedBetweenInstances(t *testing.T) {
+	stream, err := memory.New(4)
+	if err != nil {
+		t.Fatalf("unexpected error creating stream: %v", err)
+	}
+	id := data.NewID("db.table.id", "1")
+
+	// Each instance has its own engine, but they share the stream.
+	newInstance := func() http.Handler {
+		return NewEngine(stream, time.Minute, time.Hour).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+				var v string
+				if Get(r, id, &v) {
+					w.Write([]byte(v))
+					return
+				}
+				w.Write([]byte("loaded"))
+				Add(r, id, "cached")
+			case http.MethodPost:
+				Invalidate(r, id)
+			}
+		}))
+	}
+	get := func(h http.Handler) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Body.String()
+	}
+	a, b, c := newInstance(), newInstance(), newInstance()
+
+	for name, h := range map[string]http.Handler{"a": a, "b": b, "c": c} {
+		if v := get(h); v != "loaded" {
+			t.Errorf("%s: expected the first request to load the data, got %q", name, v)
+		}
+		if v := get(h); v != "cached" {
+			t.Errorf("%s: expected the second request to use the cache, got %q", name, v)
+		}
+	}
+
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+
+	for name, h := range map[string]http.Handler{"a": a, "b": b, "c": c} {
+		if v := get(h); v != "loaded" {
+			t.Errorf("%s: expected the invalidated data to be loaded again, got %q", name, v)
+		}
+	}
+}
+
+func TestInvalidationsMadeWhileTheCacheIsEmptyAreNotMissed(t *testing.T) {
+	stream, err := memory.New(4)
+	if err != nil {
+		t.Fatalf("unexpected error creating stream: %v", err)
+	}
+	id := data.NewID("db.table.id", "1")
+	engine := NewEngine(stream, time.Minute, time.Hour)
+
+	// The cache is empty, so the position is reset.
+	_, s := engine.Begin(context.Background())
+	// Another instance invalidates the data after it has been loaded, but before it's cached.
+	if err = stream.Put(context.Background(), []string{id.String()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Add(id, "stale")
+	s.End()
+
+	_, s = engine.Begin(context.Background())
+	defer s.End()
+	var v string
+	if s.Get(id, &v) {
+		t.Errorf("expected the invalidation to remove the stale data, got %q", v)
+	}
+}
@@ -0,0 +1,44 @@
+package interceptor
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+
+	"github.com/a-h/scache"
+)
+
+// Beginner begins cache sessions, e.g. *scache.Engine.
+type Beginner interface {
+	Begin(ctx context.Context) (context.Context, *scache.Session)
+}
+
+// Unary creates a gRPC interceptor which does the same as the HTTP middleware. It removes expired and
+// invalidated items from the cache, and adds the cache to the context of each call.
+func Unary(b Beginner) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		ctx, s := b.Begin(ctx)
+		defer s.End()
+		return handler(ctx, req)
+	}
+}
+
+// Stream creates a gRPC interceptor which adds the cache to the context of each stream. The cache is brought
+// up-to-date when the stream starts.
+func Stream(b Beginner) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, s := b.Begin(ss.Context())
+		defer s.End()
+		return handler(srv, serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream replaces the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss serverStream) Context() context.Context {
+	return ss.ctx
+}
@@ -0,0 +1,108 @@
+package interceptor
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/a-h/scache"
+	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/changes"
+	"github.com/a-h/scache/data"
+	"github.com/a-h/scache/expiry"
+)
+
+type testStreamGetter struct {
+	Keys []string
+}
+
+func (tsg testStreamGetter) Get(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	return tsg.Keys, from, nil
+}
+
+var (
+	invalidated = data.NewID("db.table.id", "invalidated")
+	valid       = data.NewID("db.table.id", "valid")
+)
+
+// healthServer reports SERVING when the cache is in the context, and has been brought up-to-date.
+type healthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+}
+
+func status(ctx context.Context) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	s, ok := scache.FromContext(ctx)
+	if !ok {
+		return grpc_health_v1.HealthCheckResponse_UNKNOWN
+	}
+	var v string
+	if s.Get(invalidated, &v) || !s.Get(valid, &v) {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	return grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+func (hs healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	return &grpc_health_v1.HealthCheckResponse{Status: status(ctx)}, nil
+}
+
+func (hs healthServer) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	return stream.Send(&grpc_health_v1.HealthCheckResponse{Status: status(stream.Context())})
+}
+
+func newClient(t *testing.T) grpc_health_v1.HealthClient {
+	engine := &scache.Engine{
+		Observer: changes.NewObserver(testStreamGetter{Keys: []string{invalidated.String()}}),
+		Cache:    cache.New(),
+	}
+	engine.Cache.Put(invalidated.String(), "invalidated")
+	engine.Cache.Put(valid.String(), "valid")
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(Unary(engine)), grpc.StreamInterceptor(Stream(engine)))
+	grpc_health_v1.RegisterHealthServer(srv, healthServer{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return grpc_health_v1.NewHealthClient(conn)
+}
+
+func TestUnary(t *testing.T) {
+	client := newClient(t)
+	resp, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Errorf("expected the cache to be in the context and up-to-date, got status %v", resp.Status)
+	}
+}
+
+func TestStream(t *testing.T) {
+	client := newClient(t)
+	stream, err := client.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("unexpected error receiving from stream: %v", err)
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Errorf("expected the cache to be in the context and up-to-date, got status %v", resp.Status)
+	}
+}
@@ -0,0 +1,43 @@
+package scache
+
+import "context"
+
+// LambdaHandler matches the lambda.Handler interface in github.com/aws/aws-lambda-go/lambda. Functions with
+// signatures such as func(ctx context.Context, e events.SQSEvent) (resp, error) can be converted to a
+// LambdaHandler with lambda.NewHandler.
+type LambdaHandler interface {
+	Invoke(ctx context.Context, payload []byte) ([]byte, error)
+}
+
+// LambdaHandlerFunc converts a function into a LambdaHandler.
+type LambdaHandlerFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+// Invoke calls f(ctx, payload).
+func (f LambdaHandlerFunc) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	return f(ctx, payload)
+}
+
+// WrapLambda wraps a Lambda handler for non-HTTP event sources, such as SQS and EventBridge, so that the
+// cache is brought up-to-date before each invocation, and is available in the context. The session is
+// ended before the handler returns, because the Lambda may be frozen as soon as it does.
+//
+//	lambda.StartHandler(engine.WrapLambda(lambda.NewHandler(handleSQSEvent)))
+func (e *Engine) WrapLambda(next LambdaHandler) LambdaHandler {
+	return LambdaHandlerFunc(func(ctx context.Context, payload []byte) ([]byte, error) {
+		ctx, s := e.Begin(ctx)
+		defer s.End()
+		return next.Invoke(ctx, payload)
+	})
+}
+
+// WrapLambdaFunc wraps a Lambda handler function in the same way as WrapLambda, but keeps the handler's
+// event and response types, so that it can be passed to lambda.Start.
+//
+//	lambda.Start(scache.WrapLambdaFunc(engine, handleSQSEvent))
+func WrapLambdaFunc[E, R any](e *Engine, f func(ctx context.Context, event E) (R, error)) func(ctx context.Context, event E) (R, error) {
+	return func(ctx context.Context, event E) (R, error) {
+		ctx, s := e.Begin(ctx)
+		defer s.End()
+		return f(ctx, event)
+	}
+}
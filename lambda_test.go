@@ -0,0 +1,153 @@
+package scache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/changes"
+	"github.com/a-h/scache/data"
+	"github.com/a-h/scache/expiry"
+)
+
+func TestWrapLambda(t *testing.T) {
+	// Arrange.
+	id := data.NewID("db.table.id", "1")
+	var observed bool
+	getter := testStreamGetter{
+		GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+			observed = true
+			keys = []string{id.String()}
+			return
+		},
+	}
+	engine := &Engine{
+		Observer: changes.NewObserver(getter),
+		Cache:    cache.New(),
+	}
+	engine.Cache.Put(id.String(), "value")
+	var hasSession, hit bool
+	h := engine.WrapLambda(LambdaHandlerFunc(func(ctx context.Context, payload []byte) ([]byte, error) {
+		var s *Session
+		s, hasSession = FromContext(ctx)
+		var v string
+		hit = s.Get(id, &v)
+		return payload, nil
+	}))
+
+	// Act.
+	resp, err := h.Invoke(context.Background(), []byte(`{}`))
+
+	// Assert.
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(resp) != `{}` {
+		t.Errorf("expected the response of the wrapped handler, got '%s'", string(resp))
+	}
+	if !observed {
+		t.Error("expected the stream to be observed before the handler was invoked")
+	}
+	if !hasSession {
+		t.Error("expected the session to be in the context")
+	}
+	if hit {
+		t.Error("expected the invalidated item to have been removed before the handler was invoked")
+	}
+}
+
+func TestWrapLambdaFlushesInvalidationsBeforeReturning(t *testing.T) {
+	// Arrange.
+	id := data.NewID("db.table.id", "1")
+	var puts [][]string
+	engine := &Engine{
+		Observer: changes.NewObserver(testStreamGetter{GetFunc: emptyGet}),
+		Cache:    cache.New(),
+		Notifier: changes.NewNotifier(testStreamPutter{
+			PutFunc: func(keys []string) error {
+				puts = append(puts, keys)
+				return nil
+			},
+		}),
+	}
+	var putsDuringHandler int
+	h := engine.WrapLambda(LambdaHandlerFunc(func(ctx context.Context, payload []byte) ([]byte, error) {
+		s, _ := FromContext(ctx)
+		s.Invalidate(id)
+		putsDuringHandler = len(puts)
+		return payload, nil
+	}))
+
+	// Act.
+	_, err := h.Invoke(context.Background(), []byte(`{}`))
+
+	// Assert.
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if putsDuringHandler != 0 {
+		t.Errorf("expected invalidations to be queued until the handler completes, but %d writes were made", putsDuringHandler)
+	}
+	expected := [][]string{{id.String()}}
+	if !reflect.DeepEqual(puts, expected) {
+		t.Errorf("expected the invalidations to be sent before Invoke returned, got %v", puts)
+	}
+}
+
+type testQueueEvent struct {
+	Records []string
+}
+
+func TestWrapLambdaFunc(t *testing.T) {
+	// Arrange.
+	id := data.NewID("db.table.id", "1")
+	var observed bool
+	var puts [][]string
+	engine := &Engine{
+		Observer: changes.NewObserver(testStreamGetter{
+			GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+				observed = true
+				return
+			},
+		}),
+		Cache: cache.New(),
+		Notifier: changes.NewNotifier(testStreamPutter{
+			PutFunc: func(keys []string) error {
+				puts = append(puts, keys)
+				return nil
+			},
+		}),
+	}
+	engine.Cache.Put(id.String(), "value")
+	var hasSession bool
+	h := WrapLambdaFunc(engine, func(ctx context.Context, e testQueueEvent) (int, error) {
+		var s *Session
+		s, hasSession = FromContext(ctx)
+		for _, r := range e.Records {
+			s.Invalidate(data.NewID("db.table.id", r))
+		}
+		return len(e.Records), nil
+	})
+
+	// Act.
+	resp, err := h(context.Background(), testQueueEvent{Records: []string{"1"}})
+
+	// Assert.
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != 1 {
+		t.Errorf("expected the response of the wrapped handler, got %d", resp)
+	}
+	if !observed {
+		t.Error("expected the stream to be observed before the handler was invoked")
+	}
+	if !hasSession {
+		t.Error("expected the session to be in the context")
+	}
+	expected := [][]string{{id.String()}}
+	if !reflect.DeepEqual(puts, expected) {
+		t.Errorf("expected the invalidations to be sent before the handler returned, got %v", puts)
+	}
+}
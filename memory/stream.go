@@ -0,0 +1,141 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/a-h/scache/expiry"
+)
+
+// Stream is an in-memory invalidation stream, for tests and local development. Multiple Observers in the
+// same process can share a Stream, in the same way that multiple instances share a Kinesis stream.
+//
+// Records are distributed between shards, and each record has a sequence number which is greater than any
+// previous record's. As with Kinesis, a shard which has no position in the StreamPosition is read from the
+// latest record, so only records written after the returned position are read.
+type Stream struct {
+	mutex    sync.Mutex
+	shards   []shard
+	sequence int64
+	next     int
+}
+
+type shard struct {
+	id      expiry.ShardID
+	records []record
+}
+
+type record struct {
+	sequence expiry.SequenceNumber
+	producer string
+	keys     []string
+}
+
+// ErrInvalidShardCount is returned by New when the number of shards is less than 1.
+var ErrInvalidShardCount = errors.New("memory: a stream must have at least one shard")
+
+// New creates a Stream with the given number of shards.
+func New(shards int) (s *Stream, err error) {
+	if shards < 1 {
+		err = ErrInvalidShardCount
+		return
+	}
+	s = &Stream{
+		shards: make([]shard, shards),
+	}
+	for i := range s.shards {
+		s.shards[i].id = expiry.ShardID(fmt.Sprintf("shardId-%012d", i))
+	}
+	return
+}
+
+// Put writes the keys to the stream as a single record. Records are distributed between shards in turn.
+func (s *Stream) Put(ctx context.Context, keys []string) error {
+	return s.PutFrom(ctx, "", keys)
+}
+
+// PutFrom writes the keys to the stream in the same way as Put, tagging the record with the producer, so
+// that GetFor skips it when it's called with the producer as the reader.
+func (s *Stream) PutFrom(ctx context.Context, producer string, keys []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sequence++
+	sh := &s.shards[s.next]
+	s.next = (s.next + 1) % len(s.shards)
+	sh.records = append(sh.records, record{
+		sequence: sequenceNumber(s.sequence),
+		producer: producer,
+		keys:     append([]string{}, keys...),
+	})
+	return nil
+}
+
+// sequenceNumber formats sequence numbers so that they sort in the order that they were written.
+func sequenceNumber(n int64) expiry.SequenceNumber {
+	return expiry.SequenceNumber(fmt.Sprintf("%056d", n))
+}
+
+// Get returns all of the keys added to the stream since the StreamPosition. The returned position contains
+// every shard, so that shards which had no new records keep their position.
+func (s *Stream) Get(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	return s.GetFor(ctx, "", from)
+}
+
+// GetFor returns the keys added to the stream since the StreamPosition, in the same way as Get, but skips
+// records written by PutFrom with the reader as the producer.
+func (s *Stream) GetFor(ctx context.Context, reader string, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	to = expiry.StreamPosition{}
+	for _, sh := range s.shards {
+		pos, hasPosition := from[sh.id]
+		if !hasPosition || pos == "" {
+			to[sh.id] = sh.tip()
+			continue
+		}
+		to[sh.id] = pos
+		for _, r := range sh.records {
+			if r.sequence <= pos {
+				continue
+			}
+			to[sh.id] = r.sequence
+			if reader != "" && r.producer == reader {
+				continue
+			}
+			keys = append(keys, r.keys...)
+		}
+	}
+	return
+}
+
+// tip is the position after the most recent record, or before the first record of an empty shard.
+func (sh shard) tip() expiry.SequenceNumber {
+	if len(sh.records) > 0 {
+		return sh.records[len(sh.records)-1].sequence
+	}
+	return sequenceNumber(0)
+}
+
+// Anchor returns the current position of each shard. Since records are written in the same process, no
+// records are added after at and before the position is returned.
+func (s *Stream) Anchor(ctx context.Context, at time.Time) (pos expiry.StreamPosition, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pos = expiry.StreamPosition{}
+	for _, sh := range s.shards {
+		pos[sh.id] = sh.tip()
+	}
+	return
+}
@@ -0,0 +1,133 @@
+package memory
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/a-h/scache/expiry"
+)
+
+func TestNew(t *testing.T) {
+	if _, err := New(0); err != ErrInvalidShardCount {
+		t.Errorf("expected ErrInvalidShardCount, got %v", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	tests := []struct {
+		name         string
+		before       [][]string
+		after        [][]string
+		expectedKeys []string
+	}{
+		{
+			name:         "an empty position reads from the latest record",
+			before:       [][]string{{"a"}, {"b"}, {"c"}},
+			expectedKeys: nil,
+		},
+		{
+			name:         "records written after the position are read from all shards, in shard order",
+			before:       [][]string{{"a"}},
+			after:        [][]string{{"b"}, {"c", "d"}, {"e"}},
+			expectedKeys: []string{"c", "d", "b", "e"},
+		},
+		{
+			name:         "records written to an empty stream are read",
+			after:        [][]string{{"a"}, {"b"}},
+			expectedKeys: []string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		s, err := New(2)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		for _, keys := range test.before {
+			s.Put(context.Background(), keys)
+		}
+		_, pos, err := s.Get(context.Background(), expiry.StreamPosition{})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		for _, keys := range test.after {
+			s.Put(context.Background(), keys)
+		}
+		keys, to, err := s.Get(context.Background(), pos)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(keys, test.expectedKeys) {
+			t.Errorf("%s: expected keys %v, got %v", test.name, test.expectedKeys, keys)
+		}
+		keys, _, _ = s.Get(context.Background(), to)
+		if len(keys) != 0 {
+			t.Errorf("%s: expected no keys to be read twice, got %v", test.name, keys)
+		}
+	}
+}
+
+func TestStreamKeepsThePositionOfShardsWithNoNewRecords(t *testing.T) {
+	s, _ := New(2)
+	s.Put(context.Background(), []string{"a"})
+	s.Put(context.Background(), []string{"b"})
+	_, pos, _ := s.Get(context.Background(), expiry.StreamPosition{})
+	s.Put(context.Background(), []string{"c"})
+	keys, to, _ := s.Get(context.Background(), pos)
+	if !reflect.DeepEqual(keys, []string{"c"}) {
+		t.Errorf("expected [c], got %v", keys)
+	}
+	if len(to) != 2 {
+		t.Fatalf("expected a position for both shards, got %v", to)
+	}
+	if to[s.shards[1].id] != pos[s.shards[1].id] {
+		t.Errorf("expected the second shard to keep its position, got %v", to)
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	s, err := New(2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Put(context.Background(), []string{"a"})
+	pos, err := s.Anchor(context.Background(), time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pos) != 2 {
+		t.Errorf("expected a position for each shard, got %v", pos)
+	}
+	// Records written after the anchor are read, even though Get wasn't called in between.
+	s.Put(context.Background(), []string{"b"})
+	s.Put(context.Background(), []string{"c"})
+	keys, _, err := s.Get(context.Background(), pos)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"c", "b"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestStreamSkipsTheReadersOwnRecords(t *testing.T) {
+	s, _ := New(2)
+	_, pos, _ := s.Get(context.Background(), expiry.StreamPosition{})
+	s.PutFrom(context.Background(), "engine_1", []string{"own"})
+	s.PutFrom(context.Background(), "engine_2", []string{"other"})
+	keys, to, err := s.GetFor(context.Background(), "engine_1", pos)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"other"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+	if keys, _, _ = s.Get(context.Background(), to); len(keys) != 0 {
+		t.Errorf("expected the position to move past the skipped record, got %v", keys)
+	}
+	if keys, _, _ = s.GetFor(context.Background(), "engine_2", pos); !reflect.DeepEqual(keys, []string{"own"}) {
+		t.Errorf("expected the other engine to read its record, got %v", keys)
+	}
+}
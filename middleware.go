@@ -3,13 +3,11 @@ package scache
 import (
 	"context"
 	"net/http"
-	"reflect"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 
 	"github.com/a-h/scache/data"
-	"github.com/a-h/scache/expiry"
 
 	"github.com/a-h/scache/changes"
 
@@ -18,15 +16,16 @@ import (
 
 // AddMiddleware adds the cache to the context on each HTTP request, which ensures
 // that the cache is always up-to-date.
-func AddMiddleware(next http.Handler, s expiry.Stream, minCacheDuration, maxCacheDuration time.Duration) http.Handler {
-	c := cache.New()
-	c.Expiration = cache.ExpireBetween(minCacheDuration, maxCacheDuration)
-	return &Middleware{
-		Observer: changes.NewObserver(s),
-		Cache:    c,
-		Next:     next,
-		Notifier: changes.NewNotifier(s),
-	}
+func AddMiddleware(next http.Handler, s Stream, minCacheDuration, maxCacheDuration time.Duration) http.Handler {
+	mw := NewMiddleware(s, minCacheDuration, maxCacheDuration)
+	mw.Next = next
+	return mw
+}
+
+// NewMiddleware creates the middleware without a handler to wrap. Use Begin to start a session when
+// not serving HTTP, e.g. when consuming messages from a queue.
+func NewMiddleware(s Stream, minCacheDuration, maxCacheDuration time.Duration) *Middleware {
+	return NewEngine(s, minCacheDuration, maxCacheDuration).Middleware(nil)
 }
 
 func init() {
@@ -37,79 +36,43 @@ var logger = logrus.WithField("pkg", "github.com/a-h/scache")
 
 // Middleware is HTTP middleware that adds the cache to the HTTP context of the current request.
 type Middleware struct {
-	Observer *changes.Observer
-	Notifier changes.Notifier
-	Cache    *cache.Cache
-	Next     http.Handler
+	*Engine
+	Next http.Handler
 }
 
 func (mw *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	st := time.Now()
-
-	mw.Cache.RemoveExpired()
-
-	if mw.Cache.Count() == 0 {
-		// There's a chance that something could have snuck into the cache between
-		// removing expired records, and reading the count, which means that sometimes
-		// we might update from the stream when we didn't really need to, but that's
-		// better than having a global lock.
-		mw.Observer.Reset()
-	} else {
-		toRemove, err := mw.Observer.Observe()
-		if err != nil {
-			logger.WithError(err).Error("error observing stream")
-		}
-		for _, tr := range toRemove {
-			mw.Cache.Remove(tr.String())
-		}
+	outer, hasOuter := FromContext(r.Context())
+	nested := hasOuter && outer.engine == mw.Engine
+	ctx, s := mw.Begin(r.Context())
+	defer s.End()
+
+	// When middleware is nested, the outermost middleware writes the header.
+	if mw.ServerTiming && !nested {
+		stw := &serverTimingWriter{ResponseWriter: w, s: s}
+		defer func() {
+			// If the handler didn't write anything, the response still needs the header.
+			if !stw.wroteHeader {
+				stw.WriteHeader(http.StatusOK)
+			}
+		}()
+		w = stw
 	}
 
-	// Add the cache content to the context.
-	ccc := cacheContextContent{
-		Cache:    mw.Cache,
-		Notifier: mw.Notifier,
-	}
-	ctx := context.WithValue(r.Context(), cacheContextKey, &ccc)
-
 	// Execute the handler, which can now use the Get function to retrieve items from the cache.
 	mw.Next.ServeHTTP(w, r.WithContext(ctx))
-
-	timeSpent := time.Now().Sub(st)
-	logger.
-		WithField("timeSpent", timeSpent).
-		WithField("timeSaved", ccc.TimeSaved).
-		Info("complete")
-}
-
-type contextKey string
-
-const cacheContextKey = contextKey("scache")
-
-type cacheContextContent struct {
-	Cache     *cache.Cache
-	Notifier  changes.Notifier
-	TimeSaved time.Duration
 }
 
 // Get a value from the cache, if available.
 func Get(r *http.Request, key data.ID, v interface{}) (ok bool) {
-	c, hasCache := r.Context().Value(cacheContextKey).(*cacheContextContent)
-	if !hasCache {
-		return
-	}
-	var timeSaved time.Duration
-	item, timeSaved, ok := c.Cache.GetWithDuration(key.String())
-	if !ok {
-		return
-	}
-	t := reflect.TypeOf(v)
-	if t.Kind() != reflect.Ptr || v == nil {
-		return
-	}
-	e := reflect.ValueOf(v).Elem()
-	e.Set(reflect.ValueOf(item))
-	c.TimeSaved += timeSaved
-	return
+	s, _ := FromContext(r.Context())
+	return s.Get(key, v)
+}
+
+// TryGet gets a value from the cache, if available, returning an error if the cached value can't be
+// assigned to v.
+func TryGet(r *http.Request, key data.ID, v interface{}) (ok bool, err error) {
+	s, _ := FromContext(r.Context())
+	return s.TryGet(key, v)
 }
 
 // Add a value to the cache.
@@ -120,37 +83,33 @@ func Add(r *http.Request, key data.ID, v interface{}) (ok bool) {
 // AddWithDuration adds a value to the cache, while recording how much time it would save
 // each time it's retrieved from the cache.
 func AddWithDuration(r *http.Request, key data.ID, v interface{}, d time.Duration) (ok bool) {
-	c, hasCache := GetCacheFromContext(r.Context())
-	if !hasCache {
-		return
-	}
-	c.PutWithDuration(key.String(), v, d)
-	ok = true
-	return
+	s, _ := FromContext(r.Context())
+	return s.AddWithDuration(key, v, d)
 }
 
 // GetCacheFromContext gets the cache object from the context. Should be used when wanting to customise
-// expiration of cache items or to use the cache directly.
+// expiration of cache items or to use the cache directly. The cache isn't returned while it's being bypassed
+// due to the consistency policy.
 func GetCacheFromContext(ctx context.Context) (c *cache.Cache, ok bool) {
-	ccc, ok := ctx.Value(cacheContextKey).(*cacheContextContent)
-	if !ok {
-		return
-	}
-	c = ccc.Cache
-	return
+	s, _ := FromContext(ctx)
+	return s.Cache()
 }
 
-// Invalidate invalidates some data.
-func Invalidate(r *http.Request, key data.ID) (ok bool, err error) {
-	c, ok := r.Context().Value(cacheContextKey).(*cacheContextContent)
-	if !ok {
-		return
-	}
-	err = c.Notifier.NotifyDataChanged(key)
-	if err != nil {
-		logger.WithError(err).Error("error notifying on data changed")
-		c.Cache.Remove(key.String())
-		ok = false
-	}
-	return
+// Invalidate removes data from the cache, and queues it to be invalidated in other instances. The invalidations
+// are sent to the stream in a single write after the handler completes, or when Flush is called.
+func Invalidate(r *http.Request, keys ...data.ID) (ok bool) {
+	s, _ := FromContext(r.Context())
+	return s.Invalidate(keys...)
+}
+
+// InvalidateObservables queues data to be invalidated, see Invalidate.
+func InvalidateObservables(r *http.Request, changesTo ...changes.Observable) (ok bool) {
+	s, _ := FromContext(r.Context())
+	return s.InvalidateObservables(changesTo...)
+}
+
+// Flush sends invalidations queued during the request to the stream.
+func Flush(r *http.Request) (err error) {
+	s, _ := FromContext(r.Context())
+	return s.Flush()
 }
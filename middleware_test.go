@@ -2,11 +2,18 @@ package scache
 
 import (
 	"context"
+	"errors"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/a-h/scache/adaptive"
 	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/changes"
 	"github.com/a-h/scache/data"
+	"github.com/a-h/scache/expiry"
 )
 
 type valueInCache struct {
@@ -27,10 +34,10 @@ func TestGetAndPut(t *testing.T) {
 	// Add value to cache.
 
 	//c.Put(dataKey.String(), vic)
-	ccc := cacheContextContent{
-		Cache: c,
+	s := &Session{
+		cache: c,
 	}
-	ctx := context.WithValue(r.Context(), cacheContextKey, &ccc)
+	ctx := context.WithValue(r.Context(), cacheContextKey, s)
 	r = r.WithContext(ctx)
 
 	// Act: put the vaue into the cache.
@@ -54,3 +61,290 @@ func TestGetAndPut(t *testing.T) {
 		t.Errorf("Expected the value from the cache to equal the value we put in the cache, but got B == '%v'", vic.B)
 	}
 }
+
+type testStreamGetter struct {
+	GetFunc func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error)
+}
+
+func (tsg testStreamGetter) Get(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	return tsg.GetFunc(from)
+}
+
+func failingStreamGetter() testStreamGetter {
+	return testStreamGetter{
+		GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+			err = errors.New("network error")
+			return
+		},
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	tests := []struct {
+		name             string
+		consistency      Consistency
+		maxStaleness     time.Duration
+		lastObserved     time.Time
+		expectedBypassed bool
+		expectedCount    int
+	}{
+		{
+			name:             "fail open continues to use the cache",
+			consistency:      FailOpen,
+			expectedBypassed: false,
+			expectedCount:    1,
+		},
+		{
+			name:             "fail closed flushes and bypasses the cache",
+			consistency:      FailClosed,
+			expectedBypassed: true,
+			expectedCount:    0,
+		},
+		{
+			name:             "bounded staleness uses the cache within the limit",
+			consistency:      BoundedStaleness,
+			maxStaleness:     time.Minute,
+			lastObserved:     time.Now().Add(-time.Second),
+			expectedBypassed: false,
+			expectedCount:    1,
+		},
+		{
+			name:             "bounded staleness bypasses the cache outside of the limit",
+			consistency:      BoundedStaleness,
+			maxStaleness:     time.Minute,
+			lastObserved:     time.Now().Add(-time.Hour),
+			expectedBypassed: true,
+			expectedCount:    1,
+		},
+	}
+
+	for _, test := range tests {
+		c := cache.New()
+		c.Put(data.NewID("db.table.id", "1").String(), "value")
+		var state ConsistencyState
+		var hasCache bool
+		mw := (&Engine{
+			Observer:     changes.NewObserver(failingStreamGetter()),
+			Cache:        c,
+			Consistency:  test.consistency,
+			MaxStaleness: test.maxStaleness,
+			lastObserved: test.lastObserved,
+		}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			state, _ = GetConsistencyFromContext(r.Context())
+			_, hasCache = GetCacheFromContext(r.Context())
+		}))
+		mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if state.Err == nil {
+			t.Errorf("%s: expected the stream error to be available to the handler", test.name)
+		}
+		if state.Bypassed != test.expectedBypassed {
+			t.Errorf("%s: expected bypassed to be %v, but was %v", test.name, test.expectedBypassed, state.Bypassed)
+		}
+		if hasCache == test.expectedBypassed {
+			t.Errorf("%s: expected the cache to be available to the handler: %v", test.name, !test.expectedBypassed)
+		}
+		if c.Count() != test.expectedCount {
+			t.Errorf("%s: expected %d items in the cache, got %d", test.name, test.expectedCount, c.Count())
+		}
+	}
+}
+
+func TestFailClosedRecoversWhenTheStreamCanBeRead(t *testing.T) {
+	var fail = true
+	getter := testStreamGetter{
+		GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+			if fail {
+				err = errors.New("network error")
+			}
+			return
+		},
+	}
+	c := cache.New()
+	c.Put(data.NewID("db.table.id", "1").String(), "value")
+	var state ConsistencyState
+	mw := (&Engine{
+		Observer:    changes.NewObserver(getter),
+		Cache:       c,
+		Consistency: FailClosed,
+	}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, _ = GetConsistencyFromContext(r.Context())
+	}))
+
+	// Even though the cache is now empty, the stream continues to be checked until it recovers.
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !state.Bypassed {
+		t.Error("expected the cache to be bypassed while the stream is failing")
+	}
+
+	fail = false
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if state.Bypassed {
+		t.Error("expected the cache to be used after the stream recovered")
+	}
+	if state.LastObserved.IsZero() {
+		t.Error("expected the last observation time to be set")
+	}
+}
+
+func TestCachingIsDisabledWhenItCostsMoreThanItSaves(t *testing.T) {
+	c := cache.New()
+	c.Put(data.NewID("db.table.id", "1").String(), "value")
+	var observed int
+	controller := adaptive.NewController()
+	controller.MinSessions = 0
+	controller.Window = 0
+	var state ConsistencyState
+	mw := (&Engine{
+		Observer: changes.NewObserver(testStreamGetter{
+			GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+				observed++
+				time.Sleep(time.Millisecond)
+				return
+			},
+		}),
+		Cache:      c,
+		Controller: controller,
+	}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, _ = GetConsistencyFromContext(r.Context())
+	}))
+
+	// Nothing is retrieved from the cache, so reading the stream is a waste of time.
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if observed != 1 || state.Disabled {
+		t.Fatalf("expected the first request to observe the stream, observed %d times", observed)
+	}
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if observed != 1 {
+		t.Errorf("expected the stream not to be observed once caching is disabled, observed %d times", observed)
+	}
+	if !state.Disabled || !state.Bypassed {
+		t.Errorf("expected the cache to be disabled and bypassed, got %+v", state)
+	}
+	if c.Count() != 0 {
+		t.Errorf("expected the cache to be emptied, but it contains %d items", c.Count())
+	}
+	if s := controller.Stats(); s.Enabled || len(s.Decisions) != 1 {
+		t.Errorf("expected the decision to be shown in the stats, got %+v", s)
+	}
+}
+
+func TestCachingStaysEnabledWhenItSavesMoreThanItCosts(t *testing.T) {
+	id := data.NewID("db.table.id", "1")
+	c := cache.New()
+	c.PutWithDuration(id.String(), "value", time.Hour)
+	var observed int
+	controller := adaptive.NewController()
+	controller.MinSessions = 0
+	controller.Window = 0
+	var state ConsistencyState
+	var hit bool
+	mw := (&Engine{
+		Observer: changes.NewObserver(testStreamGetter{
+			GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+				observed++
+				time.Sleep(time.Millisecond)
+				return
+			},
+		}),
+		Cache:      c,
+		Controller: controller,
+	}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, _ = GetConsistencyFromContext(r.Context())
+		var v string
+		hit = Get(r, id, &v)
+	}))
+
+	// Each request gets an item which took an hour to load, so reading the stream is worthwhile.
+	for i := 0; i < 3; i++ {
+		mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if !hit || state.Disabled {
+			t.Fatalf("request %d: expected a cache hit with caching enabled, got hit %v, %+v", i, hit, state)
+		}
+	}
+	if observed != 3 {
+		t.Errorf("expected every request to observe the stream, observed %d times", observed)
+	}
+	if s := controller.Stats(); !s.Enabled || len(s.Decisions) != 0 || s.SavedBySource["db.table.id"] == 0 {
+		t.Errorf("expected the time saved to be recorded, and caching to stay enabled, got %+v", s)
+	}
+}
+
+func TestTheCacheIsFlushedWhenThePositionExpires(t *testing.T) {
+	var expired = true
+	getter := testStreamGetter{
+		GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+			if expired {
+				err = &expiry.PositionExpiredError{Shard: "shard_1", Position: "1", Err: errors.New("trimmed")}
+			}
+			return
+		},
+	}
+	c := cache.New()
+	c.Put(data.NewID("db.table.id", "1").String(), "value")
+	var state ConsistencyState
+	engine := &Engine{
+		Observer:    changes.NewObserver(getter),
+		Cache:       c,
+		Consistency: FailClosed,
+	}
+	mw := engine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, _ = GetConsistencyFromContext(r.Context())
+	}))
+
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if c.Count() != 0 {
+		t.Errorf("expected the cache to be flushed, but it has %d items", c.Count())
+	}
+	if !state.PositionExpired {
+		t.Error("expected the expired position to be reported")
+	}
+	if state.Err != nil || state.Bypassed {
+		t.Errorf("expected the cache to be usable once flushed, got error %v, bypassed %v", state.Err, state.Bypassed)
+	}
+	if engine.PositionExpiries() != 1 {
+		t.Errorf("expected 1 position expiry, got %d", engine.PositionExpiries())
+	}
+
+	expired = false
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if state.PositionExpired {
+		t.Error("expected the expired position to be reported only once")
+	}
+}
+
+func TestTheCacheIsFlushedWhenTheBacklogIsSkipped(t *testing.T) {
+	getter := testStreamGetter{
+		GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+			err = &expiry.BacklogExceededError{Reason: "records", Records: 100000}
+			return
+		},
+	}
+	c := cache.New()
+	c.Put(data.NewID("db.table.id", "1").String(), "value")
+	var state ConsistencyState
+	engine := &Engine{
+		Observer:     changes.NewObserver(getter),
+		Cache:        c,
+		ServerTiming: true,
+	}
+	mw := engine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, _ = GetConsistencyFromContext(r.Context())
+		w.Write([]byte("OK"))
+	}))
+
+	w := httptest.NewRecorder()
+	mw.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if c.Count() != 0 {
+		t.Errorf("expected the cache to be flushed, but it has %d items", c.Count())
+	}
+	if !state.BacklogSkipped || state.Err != nil {
+		t.Errorf("expected the skipped backlog to be reported without an error, got %+v", state)
+	}
+	if header := w.Header().Get("Server-Timing"); !strings.Contains(header, `backlog;desc="skipped"`) {
+		t.Errorf("expected the skipped backlog to be included in the request metrics, got '%v'", header)
+	}
+	if engine.BacklogsSkipped() != 1 {
+		t.Errorf("expected 1 skipped backlog, got %d", engine.BacklogsSkipped())
+	}
+}
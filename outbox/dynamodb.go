@@ -0,0 +1,169 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// DynamoDBClient contains the DynamoDB functionality used by the outbox.
+type DynamoDBClient interface {
+	PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error)
+	DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error)
+	ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error)
+}
+
+// DynamoDB is an Outbox which stores messages in a DynamoDB table. The table must have a string hash key
+// named "id". Messages are deleted once they're acknowledged, so the table only contains pending messages.
+type DynamoDB struct {
+	Client    DynamoDBClient
+	TableName string
+}
+
+// NewDynamoDB creates an Outbox which stores messages in a DynamoDB table.
+func NewDynamoDB(region, tableName string) (d DynamoDB, err error) {
+	conf := &aws.Config{
+		Region: aws.String(region),
+	}
+	sess, err := session.NewSession(conf)
+	if err != nil {
+		return
+	}
+	d = DynamoDB{
+		Client:    dynamodb.New(sess),
+		TableName: tableName,
+	}
+	return
+}
+
+const (
+	dynamoIDAttribute   = "id"
+	dynamoKeysAttribute = "keys"
+	dynamoTimeAttribute = "ts"
+)
+
+// doesNotExist is the condition which prevents a message from being overwritten.
+var doesNotExist = aws.String("attribute_not_exists(" + dynamoIDAttribute + ")")
+
+// TransactWriteItem creates an item which records the message as part of a DynamoDB transaction, so that
+// the invalidation is recorded alongside the data write, e.g.:
+//
+//	msg := outbox.NewMessage(user.DataID(u.ID))
+//	_, err = client.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+//		TransactItems: []*dynamodb.TransactWriteItem{
+//			{Put: &dynamodb.Put{TableName: aws.String("users"), Item: userItem}},
+//			ob.TransactWriteItem(msg),
+//		},
+//	})
+func (d DynamoDB) TransactWriteItem(m Message) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName:           aws.String(d.TableName),
+			Item:                toItem(m),
+			ConditionExpression: doesNotExist,
+		},
+	}
+}
+
+// Add puts the messages into the table.
+func (d DynamoDB) Add(ctx context.Context, msgs ...Message) (err error) {
+	for _, m := range msgs {
+		_, err = d.Client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(d.TableName),
+			Item:                toItem(m),
+			ConditionExpression: doesNotExist,
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			// The message has already been added.
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Pending scans the table for messages.
+func (d DynamoDB) Pending(ctx context.Context) (msgs []Message, err error) {
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		var out *dynamodb.ScanOutput
+		out, err = d.Client.ScanWithContext(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(d.TableName),
+			ConsistentRead:    aws.Bool(true),
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return
+		}
+		for _, item := range out.Items {
+			var m Message
+			if m, err = fromItem(item); err != nil {
+				return
+			}
+			msgs = append(msgs, m)
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Time.Before(msgs[j].Time) })
+	return
+}
+
+// Ack deletes the messages from the table.
+func (d DynamoDB) Ack(ctx context.Context, ids ...string) (err error) {
+	for _, id := range ids {
+		_, err = d.Client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(d.TableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				dynamoIDAttribute: {S: aws.String(id)},
+			},
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func toItem(m Message) map[string]*dynamodb.AttributeValue {
+	keys := make([]*dynamodb.AttributeValue, len(m.Keys))
+	for i, k := range m.Keys {
+		keys[i] = &dynamodb.AttributeValue{S: aws.String(k)}
+	}
+	return map[string]*dynamodb.AttributeValue{
+		dynamoIDAttribute:   {S: aws.String(m.ID)},
+		dynamoKeysAttribute: {L: keys},
+		dynamoTimeAttribute: {S: aws.String(m.Time.UTC().Format(time.RFC3339Nano))},
+	}
+}
+
+func fromItem(item map[string]*dynamodb.AttributeValue) (m Message, err error) {
+	id, ok := item[dynamoIDAttribute]
+	if !ok || id.S == nil {
+		err = errors.New("outbox: item is missing an ID")
+		return
+	}
+	m.ID = *id.S
+	if keys, ok := item[dynamoKeysAttribute]; ok {
+		for _, k := range keys.L {
+			m.Keys = append(m.Keys, aws.StringValue(k.S))
+		}
+	}
+	if ts, ok := item[dynamoTimeAttribute]; ok && ts.S != nil {
+		if m.Time, err = time.Parse(time.RFC3339Nano, *ts.S); err != nil {
+			err = errors.New("outbox: failed to parse time of message '" + m.ID + "': " + err.Error())
+		}
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package outbox
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// testDynamoDBClient stores items in memory.
+type testDynamoDBClient struct {
+	Items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (c *testDynamoDBClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	id := *input.Item["id"].S
+	if _, exists := c.Items[id]; exists && input.ConditionExpression != nil {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "exists", nil)
+	}
+	c.Items[id] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (c *testDynamoDBClient) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	delete(c.Items, *input.Key["id"].S)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// Scan returns one item per page.
+func (c *testDynamoDBClient) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	var ids []string
+	for id := range c.Items {
+		ids = append(ids, id)
+	}
+	var next string
+	if input.ExclusiveStartKey != nil {
+		next = *input.ExclusiveStartKey["id"].S
+	}
+	out := &dynamodb.ScanOutput{}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if id > next {
+			out.Items = append(out.Items, c.Items[id])
+			out.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}}
+			break
+		}
+	}
+	return out, nil
+}
+
+func TestDynamoDB(t *testing.T) {
+	client := &testDynamoDBClient{Items: map[string]map[string]*dynamodb.AttributeValue{}}
+	ob := DynamoDB{
+		Client:    client,
+		TableName: "outbox",
+	}
+	m1 := Message{ID: "1", Keys: []string{"a", "b"}, Time: time.Date(2018, time.June, 11, 14, 0, 0, 0, time.UTC)}
+	m2 := Message{ID: "2", Keys: []string{"c"}, Time: time.Date(2018, time.June, 11, 13, 0, 0, 0, time.UTC)}
+	duplicate := Message{ID: "1", Keys: []string{"d"}, Time: time.Date(2018, time.June, 11, 15, 0, 0, 0, time.UTC)}
+
+	if err := ob.Add(context.Background(), m1, m2, duplicate); err != nil {
+		t.Fatalf("unexpected error adding messages: %v", err)
+	}
+	pending, err := ob.Pending(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting pending messages: %v", err)
+	}
+	if expected := []Message{m2, m1}; !reflect.DeepEqual(pending, expected) {
+		t.Errorf("expected %v, got %v", expected, pending)
+	}
+
+	if err = ob.Ack(context.Background(), "1"); err != nil {
+		t.Fatalf("unexpected error acknowledging messages: %v", err)
+	}
+	pending, err = ob.Pending(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting pending messages: %v", err)
+	}
+	if expected := []Message{m2}; !reflect.DeepEqual(pending, expected) {
+		t.Errorf("after ack, expected %v, got %v", expected, pending)
+	}
+}
+
+func TestDynamoDBTransactWriteItem(t *testing.T) {
+	ob := DynamoDB{TableName: "outbox"}
+	m := Message{ID: "1", Keys: []string{"a"}, Time: time.Date(2018, time.June, 11, 14, 0, 0, 0, time.UTC)}
+	twi := ob.TransactWriteItem(m)
+	if *twi.Put.TableName != "outbox" {
+		t.Errorf("expected the outbox table, got '%v'", *twi.Put.TableName)
+	}
+	if twi.Put.ConditionExpression == nil {
+		t.Error("expected a condition to prevent duplicate messages")
+	}
+	actual, err := fromItem(twi.Put.Item)
+	if err != nil {
+		t.Fatalf("unexpected error reading item: %v", err)
+	}
+	if !reflect.DeepEqual(actual, m) {
+		t.Errorf("expected %v, got %v", m, actual)
+	}
+}
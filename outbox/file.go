@@ -0,0 +1,122 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// File is an Outbox which stores each message as a file in a directory.
+type File struct {
+	Dir string
+}
+
+// NewFile creates an Outbox which stores messages in the directory, creating it if required.
+func NewFile(dir string) (f File, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	f = File{
+		Dir: dir,
+	}
+	return
+}
+
+const fileExtension = ".json"
+
+func (f File) path(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return "", errors.New("outbox: invalid message ID '" + id + "'")
+	}
+	return filepath.Join(f.Dir, id+fileExtension), nil
+}
+
+// Add writes each message to a file. The file is written to a temporary location and renamed, so that
+// partially written messages are never read. The context is checked before each message is written.
+func (f File) Add(ctx context.Context, msgs ...Message) (err error) {
+	for _, m := range msgs {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = f.add(m); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (f File) add(m Message) (err error) {
+	p, err := f.path(m.ID)
+	if err != nil {
+		return
+	}
+	if _, statErr := os.Stat(p); statErr == nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(f.Dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if err = json.NewEncoder(tmp).Encode(m); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Pending reads all of the messages in the directory.
+func (f File) Pending(ctx context.Context) (msgs []Message, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	files, err := ioutil.ReadDir(f.Dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || filepath.Ext(fi.Name()) != fileExtension {
+			continue
+		}
+		var b []byte
+		b, err = ioutil.ReadFile(filepath.Join(f.Dir, fi.Name()))
+		if err != nil {
+			return
+		}
+		var m Message
+		if err = json.Unmarshal(b, &m); err != nil {
+			err = errors.New("outbox: failed to read message '" + fi.Name() + "': " + err.Error())
+			return
+		}
+		msgs = append(msgs, m)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Time.Before(msgs[j].Time) })
+	return
+}
+
+// Ack deletes the messages' files.
+func (f File) Ack(ctx context.Context, ids ...string) (err error) {
+	for _, id := range ids {
+		var p string
+		if p, err = f.path(id); err != nil {
+			return
+		}
+		if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+	return
+}
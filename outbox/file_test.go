@@ -0,0 +1,52 @@
+package outbox
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	ob, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create outbox: %v", err)
+	}
+	m1 := Message{ID: "1", Keys: []string{"a", "b"}, Time: time.Date(2018, time.June, 11, 14, 0, 0, 0, time.UTC)}
+	m2 := Message{ID: "2", Keys: []string{"c"}, Time: time.Date(2018, time.June, 11, 13, 0, 0, 0, time.UTC)}
+	duplicate := Message{ID: "1", Keys: []string{"d"}, Time: time.Date(2018, time.June, 11, 15, 0, 0, 0, time.UTC)}
+
+	if err = ob.Add(context.Background(), m1, m2, duplicate); err != nil {
+		t.Fatalf("unexpected error adding messages: %v", err)
+	}
+	pending, err := ob.Pending(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting pending messages: %v", err)
+	}
+	if expected := []Message{m2, m1}; !reflect.DeepEqual(pending, expected) {
+		t.Errorf("expected %v, got %v", expected, pending)
+	}
+
+	if err = ob.Ack(context.Background(), "1", "3"); err != nil {
+		t.Fatalf("unexpected error acknowledging messages: %v", err)
+	}
+	pending, err = ob.Pending(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting pending messages: %v", err)
+	}
+	if expected := []Message{m2}; !reflect.DeepEqual(pending, expected) {
+		t.Errorf("after ack, expected %v, got %v", expected, pending)
+	}
+}
+
+func TestFileRejectsInvalidIDs(t *testing.T) {
+	ob, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create outbox: %v", err)
+	}
+	for _, id := range []string{"", "../1", ".hidden"} {
+		if err = ob.Add(context.Background(), Message{ID: id}); err == nil {
+			t.Errorf("expected an error adding a message with ID '%v'", id)
+		}
+	}
+}
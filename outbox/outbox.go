@@ -0,0 +1,145 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/a-h/scache/data"
+)
+
+// Message is a set of invalidations to send to the stream.
+type Message struct {
+	// ID uniquely identifies the message, so that duplicates can be ignored.
+	ID string `json:"id"`
+	// Keys are the data keys to invalidate.
+	Keys []string `json:"keys"`
+	// Time is when the message was created.
+	Time time.Time `json:"ts"`
+}
+
+// NewMessage creates a message which invalidates the data.
+func NewMessage(ids ...data.ID) Message {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = id.String()
+	}
+	return newMessage(keys)
+}
+
+func newMessage(keys []string) Message {
+	return Message{
+		ID:   newID(),
+		Keys: keys,
+		Time: time.Now().UTC(),
+	}
+}
+
+func newID() string {
+	vs := make([]byte, 16)
+	rand.Read(vs)
+	return hex.EncodeToString(vs)
+}
+
+// Outbox durably stores messages until they've been sent to the stream.
+type Outbox interface {
+	// Add records messages. Adding a message with the same ID as an existing message has no effect.
+	Add(ctx context.Context, msgs ...Message) error
+	// Pending returns the messages which haven't been acknowledged, oldest first.
+	Pending(ctx context.Context) ([]Message, error)
+	// Ack removes messages which have been sent to the stream.
+	Ack(ctx context.Context, ids ...string) error
+}
+
+// MessagePutter sends messages to the stream. The expiry.Stream is a MessagePutter.
+type MessagePutter interface {
+	PutMessage(ctx context.Context, id string, keys []string) error
+}
+
+// Relay sends messages from the outbox to the stream.
+type Relay struct {
+	Outbox Outbox
+	Stream MessagePutter
+}
+
+// Send sends messages to the stream, and acknowledges them once sent. Messages which can't be sent remain
+// in the outbox to be sent by Run.
+func (r Relay) Send(ctx context.Context, msgs ...Message) (err error) {
+	var sent []string
+	for _, m := range msgs {
+		if err = r.Stream.PutMessage(ctx, m.ID, m.Keys); err != nil {
+			err = errors.New("outbox: failed to send message '" + m.ID + "': " + err.Error())
+			break
+		}
+		sent = append(sent, m.ID)
+	}
+	if len(sent) == 0 {
+		return
+	}
+	if ackErr := r.Outbox.Ack(ctx, sent...); ackErr != nil && err == nil {
+		// The messages will be sent again, but readers will ignore the duplicates.
+		err = errors.New("outbox: failed to acknowledge messages: " + ackErr.Error())
+	}
+	return
+}
+
+// Run sends all pending messages to the stream, returning the number of messages sent. Messages which can't
+// be sent are skipped, so that they don't hold up later messages, and are reported in the returned error.
+// They remain in the outbox to be sent by the next run. If the context is done, Run stops, and the
+// remaining messages are sent by the next run.
+func (r Relay) Run(ctx context.Context) (sent int, err error) {
+	msgs, err := r.Outbox.Pending(ctx)
+	if err != nil {
+		err = errors.New("outbox: failed to get pending messages: " + err.Error())
+		return
+	}
+	var failures []string
+	for _, m := range msgs {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			failures = append(failures, "outbox: stopped sending messages: "+ctxErr.Error())
+			break
+		}
+		if sendErr := r.Send(ctx, m); sendErr != nil {
+			failures = append(failures, sendErr.Error())
+			continue
+		}
+		sent++
+	}
+	if len(failures) > 0 {
+		err = errors.New(strings.Join(failures, ", "))
+	}
+	return
+}
+
+// Putter records invalidations in the outbox before sending them to the stream, so that if the stream can't
+// be written to, they can be sent later by the Relay. Use it in place of the stream when creating a
+// changes.Notifier.
+type Putter struct {
+	Relay Relay
+}
+
+// NewPutter creates a Putter which records invalidations in the outbox before sending them to the stream.
+func NewPutter(o Outbox, s MessagePutter) Putter {
+	return Putter{
+		Relay: Relay{
+			Outbox: o,
+			Stream: s,
+		},
+	}
+}
+
+// Put records the keys in the outbox, then sends them to the stream.
+func (p Putter) Put(ctx context.Context, keys []string) (err error) {
+	m := newMessage(keys)
+	if err = p.Relay.Outbox.Add(ctx, m); err != nil {
+		// It's still worth trying to send the message directly.
+		if sendErr := p.Relay.Stream.PutMessage(ctx, m.ID, m.Keys); sendErr != nil {
+			return errors.New("outbox: failed to record message: " + err.Error() + ", failed to send message: " + sendErr.Error())
+		}
+		return nil
+	}
+	return p.Relay.Send(ctx, m)
+}
@@ -0,0 +1,122 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-h/scache/data"
+)
+
+type testMessagePutter struct {
+	Fail bool
+	// FailIDs are the IDs of messages which can't be sent.
+	FailIDs map[string]bool
+	Sent    map[string][]string
+}
+
+func (tmp *testMessagePutter) PutMessage(ctx context.Context, id string, keys []string) error {
+	if tmp.Fail || tmp.FailIDs[id] {
+		return errors.New("network error")
+	}
+	if tmp.Sent == nil {
+		tmp.Sent = map[string][]string{}
+	}
+	tmp.Sent[id] = keys
+	return nil
+}
+
+func TestPutterSendsMessagesLaterIfTheStreamFails(t *testing.T) {
+	// Arrange.
+	ob, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create outbox: %v", err)
+	}
+	stream := &testMessagePutter{Fail: true}
+	p := NewPutter(ob, stream)
+	keys := []string{data.NewID("db.table.id", "1").String()}
+
+	// Act.
+	err = p.Put(context.Background(), keys)
+
+	// Assert.
+	if err == nil {
+		t.Fatal("expected an error when the stream fails")
+	}
+	pending, err := ob.Pending(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting pending messages: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("expected the message to be pending, got %d pending messages", len(pending))
+	}
+
+	// Act: the stream recovers.
+	stream.Fail = false
+	sent, err := p.Relay.Run(context.Background())
+
+	// Assert.
+	if err != nil {
+		t.Fatalf("unexpected error running relay: %v", err)
+	}
+	if sent != 1 {
+		t.Errorf("expected 1 message to be sent, got %d", sent)
+	}
+	if !reflect.DeepEqual(stream.Sent[pending[0].ID], keys) {
+		t.Errorf("expected keys %v to be sent, got %v", keys, stream.Sent)
+	}
+	if pending, _ = ob.Pending(context.Background()); len(pending) != 0 {
+		t.Errorf("expected no pending messages after the relay ran, got %d", len(pending))
+	}
+}
+
+func TestPutterAcknowledgesSentMessages(t *testing.T) {
+	ob, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create outbox: %v", err)
+	}
+	stream := &testMessagePutter{}
+	err = NewPutter(ob, stream).Put(context.Background(), []string{"key"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stream.Sent) != 1 {
+		t.Errorf("expected a message to be sent, got %d", len(stream.Sent))
+	}
+	if pending, _ := ob.Pending(context.Background()); len(pending) != 0 {
+		t.Errorf("expected no pending messages, got %d", len(pending))
+	}
+}
+
+func TestRelaySkipsMessagesWhichCantBeSent(t *testing.T) {
+	// Arrange.
+	ob, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create outbox: %v", err)
+	}
+	now := time.Now()
+	stuck := Message{ID: "stuck", Keys: []string{"key_1"}, Time: now}
+	later := Message{ID: "later", Keys: []string{"key_2"}, Time: now.Add(time.Second)}
+	if err = ob.Add(context.Background(), stuck, later); err != nil {
+		t.Fatalf("failed to add messages: %v", err)
+	}
+	stream := &testMessagePutter{FailIDs: map[string]bool{"stuck": true}}
+
+	// Act.
+	sent, err := Relay{Outbox: ob, Stream: stream}.Run(context.Background())
+
+	// Assert.
+	if err == nil || !strings.Contains(err.Error(), "stuck") {
+		t.Errorf("expected the failed message to be reported, got %v", err)
+	}
+	if sent != 1 || !reflect.DeepEqual(stream.Sent["later"], later.Keys) {
+		t.Errorf("expected the later message to be sent, got %d sent: %v", sent, stream.Sent)
+	}
+	pending, _ := ob.Pending(context.Background())
+	if len(pending) != 1 || pending[0].ID != "stuck" {
+		t.Errorf("expected only the failed message to remain pending, got %v", pending)
+	}
+}
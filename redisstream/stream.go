@@ -0,0 +1,225 @@
+package redisstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/a-h/scache/expiry"
+)
+
+// Client contains the Redis commands used by the Stream, e.g. *redis.Client.
+type Client interface {
+	XAdd(a *redis.XAddArgs) *redis.StringCmd
+	XRead(a *redis.XReadArgs) *redis.XStreamSliceCmd
+	XRangeN(stream, start, stop string, count int64) *redis.XMessageSliceCmd
+	XRevRangeN(stream, start, stop string, count int64) *redis.XMessageSliceCmd
+}
+
+// Stream provides a way to send and receive invalidations using a Redis Stream. Each reader keeps its own
+// position, so no consumer groups are required.
+type Stream struct {
+	// Name is the key of the Redis Stream.
+	Name string
+	// MaxLen is the approximate maximum number of entries kept in the stream. Older entries are trimmed when
+	// new entries are added. If zero, the stream isn't trimmed.
+	MaxLen int64
+	// Count is the maximum number of entries read by each XREAD command.
+	Count  int64
+	client Client
+}
+
+// Field names of each stream entry.
+const (
+	keysField     = "keys"
+	timeField     = "ts"
+	producerField = "producer"
+)
+
+// NewStream creates a Stream which reads and writes to the named Redis Stream, keeping approximately the
+// last 10,000 entries.
+func NewStream(client Client, name string) *Stream {
+	return &Stream{
+		Name:   name,
+		MaxLen: 10000,
+		Count:  1000,
+		client: client,
+	}
+}
+
+// Put adds the keys to the stream in a single entry. Redis commands don't accept a context, so the time
+// spent waiting for Redis is limited by the client's timeouts, rather than the context.
+func (s *Stream) Put(ctx context.Context, keys []string) (err error) {
+	return s.PutFrom(ctx, "", keys)
+}
+
+// PutFrom adds the keys to the stream in a single entry, tagged with the producer, so that GetFor skips the
+// entry when it's called with the producer as the reader.
+func (s *Stream) PutFrom(ctx context.Context, producer string, keys []string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return
+	}
+	err = s.client.XAdd(&redis.XAddArgs{
+		Stream:       s.Name,
+		MaxLenApprox: s.MaxLen,
+		Values: map[string]interface{}{
+			keysField:     string(data),
+			timeField:     time.Now().UTC().Format(time.RFC3339Nano),
+			producerField: producer,
+		},
+	}).Err()
+	if err != nil {
+		err = fmt.Errorf("redisstream: failed to add to stream '%s': %v", s.Name, err)
+	}
+	return
+}
+
+// Get returns all of the keys added to the stream since the StreamPosition. The stream has a single "shard",
+// named after the stream, and the position within it is the ID of the last entry read. If there's no
+// position, Get starts after the latest entry. If entries after the position have been trimmed from the
+// stream, a *expiry.PositionExpiredError is returned. The context is checked between commands. If it's done,
+// the keys and position read so far are returned with its error.
+func (s *Stream) Get(ctx context.Context, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	return s.GetFor(ctx, "", from)
+}
+
+// GetFor returns the keys added to the stream since the StreamPosition, in the same way as Get, but skips
+// entries written by PutFrom with the reader as the producer.
+func (s *Stream) GetFor(ctx context.Context, reader string, from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	shard := expiry.ShardID(s.Name)
+	last := string(from[shard])
+	if last == "" {
+		last, err = s.latestID()
+		if err != nil {
+			return
+		}
+	} else if err = s.checkPosition(last); err != nil {
+		return
+	}
+	for {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var streams []redis.XStream
+		streams, err = s.client.XRead(&redis.XReadArgs{
+			Streams: []string{s.Name, last},
+			Count:   s.Count,
+			// Don't block, there's no need to wait for new entries.
+			Block: -1,
+		}).Result()
+		if err == redis.Nil {
+			err = nil
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("redisstream: failed to read stream '%s' from '%s': %v", s.Name, last, err)
+			return
+		}
+		var read int64
+		for _, st := range streams {
+			for _, m := range st.Messages {
+				read++
+				last = m.ID
+				if p, _ := m.Values[producerField].(string); reader != "" && p == reader {
+					continue
+				}
+				var k []string
+				if err = json.Unmarshal([]byte(fmt.Sprint(m.Values[keysField])), &k); err != nil {
+					err = fmt.Errorf("redisstream: failed to read keys of entry '%s': %v", m.ID, err)
+					return
+				}
+				keys = append(keys, k...)
+			}
+		}
+		if s.Count <= 0 || read < s.Count {
+			break
+		}
+	}
+	to = expiry.StreamPosition{shard: expiry.SequenceNumber(last)}
+	return
+}
+
+// Anchor returns the position of the latest entry in the stream, so that entries added after at are read
+// by the next call to Get.
+func (s *Stream) Anchor(ctx context.Context, at time.Time) (pos expiry.StreamPosition, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	id, err := s.latestID()
+	if err != nil {
+		return
+	}
+	pos = expiry.StreamPosition{expiry.ShardID(s.Name): expiry.SequenceNumber(id)}
+	return
+}
+
+// checkPosition returns a *expiry.PositionExpiredError if entries after the position may have been trimmed
+// from the stream, i.e. the oldest entry in the stream is newer than the position, or the stream no longer
+// exists.
+func (s *Stream) checkPosition(last string) (err error) {
+	if last == "0-0" {
+		return
+	}
+	msgs, err := s.client.XRangeN(s.Name, "-", "+", 1).Result()
+	if err != nil && err != redis.Nil {
+		err = fmt.Errorf("redisstream: failed to get the oldest entry of stream '%s': %v", s.Name, err)
+		return
+	}
+	err = nil
+	if len(msgs) > 0 && !idBefore(last, msgs[0].ID) {
+		return
+	}
+	return &expiry.PositionExpiredError{
+		Shard:    expiry.ShardID(s.Name),
+		Position: expiry.SequenceNumber(last),
+		Err:      errors.New("redisstream: entries after the position have been trimmed from the stream"),
+	}
+}
+
+// idBefore returns true if the stream entry ID a is before b. IDs are made up of a millisecond timestamp and
+// a sequence number, e.g. "1526919030474-55".
+func idBefore(a, b string) bool {
+	at, as := parseID(a)
+	bt, bs := parseID(b)
+	return at < bt || (at == bt && as < bs)
+}
+
+func parseID(id string) (ms, seq uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ = strconv.ParseUint(parts[0], 10, 64)
+	if len(parts) > 1 {
+		seq, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	return
+}
+
+// latestID returns the ID of the latest entry in the stream, or "0-0" if the stream is empty.
+func (s *Stream) latestID() (id string, err error) {
+	msgs, err := s.client.XRevRangeN(s.Name, "+", "-", 1).Result()
+	if err != nil && err != redis.Nil {
+		err = fmt.Errorf("redisstream: failed to get the latest entry of stream '%s': %v", s.Name, err)
+		return
+	}
+	err = nil
+	id = "0-0"
+	if len(msgs) > 0 {
+		id = msgs[0].ID
+	}
+	return
+}
@@ -0,0 +1,222 @@
+package redisstream
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+
+	"github.com/a-h/scache/expiry"
+)
+
+func newTestStreams(t *testing.T) (writer, reader *Stream, mr *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("failed to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	writer = NewStream(client, "invalidations")
+	reader = NewStream(client, "invalidations")
+	return
+}
+
+func TestStream(t *testing.T) {
+	writer, reader, _ := newTestStreams(t)
+
+	// Anchor the reader at the end of the empty stream.
+	keys, pos, err := reader.Get(context.Background(), expiry.StreamPosition{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected no keys from an empty stream, got %v", keys)
+	}
+	if pos[expiry.ShardID("invalidations")] != "0-0" {
+		t.Errorf("expected the position to be the start of the stream, got %v", pos)
+	}
+
+	if err = writer.Put(context.Background(), []string{"a", "b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = writer.Put(context.Background(), []string{"c"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys, pos, err = reader.Get(context.Background(), pos)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+
+	keys, to, err := reader.Get(context.Background(), pos)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected no keys to be read twice, got %v", keys)
+	}
+	if !reflect.DeepEqual(to, pos) {
+		t.Errorf("expected the position to be unchanged at %v, got %v", pos, to)
+	}
+}
+
+func TestStreamStartsFromTheLatestEntry(t *testing.T) {
+	writer, reader, _ := newTestStreams(t)
+	writer.Put(context.Background(), []string{"old"})
+	keys, pos, err := reader.Get(context.Background(), expiry.StreamPosition{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected entries written before the first read to be skipped, got %v", keys)
+	}
+	writer.Put(context.Background(), []string{"new"})
+	keys, _, _ = reader.Get(context.Background(), pos)
+	if expected := []string{"new"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestStreamReadsInPages(t *testing.T) {
+	writer, reader, _ := newTestStreams(t)
+	reader.Count = 2
+	_, pos, _ := reader.Get(context.Background(), expiry.StreamPosition{})
+	var expected []string
+	for i := 0; i < 5; i++ {
+		k := strconv.Itoa(i)
+		expected = append(expected, k)
+		writer.Put(context.Background(), []string{k})
+	}
+	keys, _, err := reader.Get(context.Background(), pos)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestStreamSkipsTheReadersOwnEntries(t *testing.T) {
+	// Two engines share the same Stream.
+	s, _, _ := newTestStreams(t)
+	_, pos, _ := s.Get(context.Background(), expiry.StreamPosition{})
+	s.PutFrom(context.Background(), "engine_1", []string{"own"})
+	s.PutFrom(context.Background(), "engine_2", []string{"other"})
+	keys, to, err := s.GetFor(context.Background(), "engine_1", pos)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"other"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+	if keys, _, _ = s.GetFor(context.Background(), "engine_1", to); len(keys) != 0 {
+		t.Errorf("expected the position to move past all entries, got %v", keys)
+	}
+	keys, _, err = s.GetFor(context.Background(), "engine_2", pos)
+	if expected := []string{"own"}; err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected the other engine to read keys %v, got %v, %v", expected, keys, err)
+	}
+}
+
+func TestStreamIsTrimmed(t *testing.T) {
+	writer, _, mr := newTestStreams(t)
+	writer.MaxLen = 3
+	for i := 0; i < 10; i++ {
+		writer.Put(context.Background(), []string{strconv.Itoa(i)})
+	}
+	entries, err := mr.Stream("invalidations")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(entries) > 3 {
+		t.Errorf("expected the stream to be trimmed to 3 entries, got %d", len(entries))
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	_, reader, mr := newTestStreams(t)
+	mr.SetError("unavailable")
+	if _, _, err := reader.Get(context.Background(), expiry.StreamPosition{}); err == nil {
+		t.Errorf("expected an error reading from an unavailable server")
+	}
+	if err := reader.Put(context.Background(), []string{"a"}); err == nil {
+		t.Errorf("expected an error writing to an unavailable server")
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	writer, reader, _ := newTestStreams(t)
+
+	pos, err := reader.Anchor(context.Background(), time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pos[expiry.ShardID("invalidations")] != "0-0" {
+		t.Errorf("expected an empty stream to be anchored at the start, got %v", pos)
+	}
+	if err = writer.Put(context.Background(), []string{"a"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pos, err = reader.Anchor(context.Background(), time.Now()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = writer.Put(context.Background(), []string{"b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys, _, err := reader.Get(context.Background(), pos)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"b"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestTrimmedPositionsHaveExpired(t *testing.T) {
+	writer, reader, mr := newTestStreams(t)
+	writer.MaxLen = 3
+	writer.Put(context.Background(), []string{"a"})
+	_, pos, err := reader.Get(context.Background(), expiry.StreamPosition{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		writer.Put(context.Background(), []string{strconv.Itoa(i)})
+	}
+	_, _, err = reader.Get(context.Background(), pos)
+	if _, ok := err.(*expiry.PositionExpiredError); !ok {
+		t.Errorf("expected a *expiry.PositionExpiredError once the position has been trimmed, got %v", err)
+	}
+
+	// The stream no longer exists, e.g. Redis was restarted.
+	mr.FlushAll()
+	_, _, err = reader.Get(context.Background(), pos)
+	if _, ok := err.(*expiry.PositionExpiredError); !ok {
+		t.Errorf("expected a *expiry.PositionExpiredError once the stream has been removed, got %v", err)
+	}
+}
+
+func TestIDBefore(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected bool
+	}{
+		{a: "1-0", b: "2-0", expected: true},
+		{a: "2-0", b: "1-0", expected: false},
+		{a: "1-1", b: "1-2", expected: true},
+		{a: "1-2", b: "1-2", expected: false},
+		{a: "9-0", b: "10-0", expected: true},
+	}
+	for _, test := range tests {
+		if actual := idBefore(test.a, test.b); actual != test.expected {
+			t.Errorf("expected idBefore(%q, %q) to be %v, got %v", test.a, test.b, test.expected, actual)
+		}
+	}
+}
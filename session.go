@@ -0,0 +1,259 @@
+package scache
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/a-h/scache/adaptive"
+	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/changes"
+	"github.com/a-h/scache/data"
+)
+
+type contextKey string
+
+const cacheContextKey = contextKey("scache")
+
+// Session is the cache state of a single unit of work, e.g. an HTTP request, or a message read from a queue.
+// It's created by Begin, and retrieved from the context using FromContext. A nil Session behaves as if
+// the cache is empty.
+type Session struct {
+	engine       *Engine
+	refs         int32
+	cache        *cache.Cache
+	notifier     changes.Notifier
+	onFlushError FlushErrorHandler
+	start        time.Time
+	handlerStart time.Time
+	// deadline is the deadline of the context passed to Begin, if it has one.
+	deadline    time.Time
+	hasDeadline bool
+	timings     timings
+	consistency ConsistencyState
+	controller  *adaptive.Controller
+	ttlPolicy   *adaptive.TTLPolicy
+
+	mutex   sync.Mutex
+	pending []data.ID
+}
+
+// FlushErrorHandler is called when invalidations can't be sent to the stream. Since invalidations are
+// usually sent after the response has been written, the error can't be returned to the caller.
+type FlushErrorHandler func(ids []data.ID, err error)
+
+// FromContext gets the session started by Begin from the context.
+func FromContext(ctx context.Context) (s *Session, ok bool) {
+	s, ok = ctx.Value(cacheContextKey).(*Session)
+	return
+}
+
+// End completes the session, sending any pending invalidations to the stream, and logging how much time
+// it took, and how much time the cache saved. If the session was reused by nested calls to Begin, it's
+// completed when the outermost caller ends it.
+func (s *Session) End() {
+	if s == nil || atomic.AddInt32(&s.refs, -1) > 0 {
+		return
+	}
+	atomic.AddInt64(&s.timings.handler, int64(time.Now().Sub(s.handlerStart)))
+	s.Flush()
+	timeSpent := time.Now().Sub(s.start)
+	t := s.Timings()
+	logger.
+		WithField("timeSpent", timeSpent).
+		WithField("timeExpiring", t.Expire).
+		WithField("timeObserving", t.Observe).
+		WithField("timeInHandler", t.Handler).
+		WithField("timeFlushing", t.Flush).
+		WithField("timeSaved", t.Saved).
+		WithField("hits", t.Hits).
+		WithField("misses", t.Misses).
+		WithField("backlogSkipped", t.BacklogSkipped).
+		Info("complete")
+}
+
+// Timings returns where time has been spent during the session, and how much time the cache has saved.
+func (s *Session) Timings() Timings {
+	if s == nil {
+		return Timings{}
+	}
+	return s.timings.get()
+}
+
+// Consistency returns the state of the cache for the session.
+func (s *Session) Consistency() ConsistencyState {
+	if s == nil {
+		return ConsistencyState{}
+	}
+	return s.consistency
+}
+
+// Cache returns the cache object. Should be used when wanting to customise expiration of cache items or
+// to use the cache directly. The cache isn't returned while it's being bypassed due to the consistency policy.
+func (s *Session) Cache() (c *cache.Cache, ok bool) {
+	if s == nil || s.consistency.Bypassed {
+		return
+	}
+	return s.cache, true
+}
+
+// Get a value from the cache, if available. If the cached value can't be assigned to v, the error is logged
+// and the value is treated as a miss.
+func (s *Session) Get(key data.ID, v interface{}) (ok bool) {
+	ok, err := s.TryGet(key, v)
+	if err != nil {
+		logger.WithError(err).WithField("key", key.String()).Warn("failed to get value from cache")
+	}
+	return
+}
+
+// TryGet gets a value from the cache, if available. The value is assigned to v, which must be a pointer.
+// Values stored as pointers can be retrieved as values, and vice versa, and numeric values are converted.
+// If the value can't be assigned to v, a *TypeMismatchError is returned.
+func (s *Session) TryGet(key data.ID, v interface{}) (ok bool, err error) {
+	if s == nil {
+		return
+	}
+	defer func() {
+		if ok {
+			atomic.AddInt64(&s.timings.hits, 1)
+			return
+		}
+		atomic.AddInt64(&s.timings.misses, 1)
+	}()
+	c, hasCache := s.Cache()
+	if !hasCache {
+		return
+	}
+	dst := reflect.ValueOf(v)
+	if v == nil || dst.Kind() != reflect.Ptr || dst.IsNil() {
+		err = ErrInvalidDestination
+		return
+	}
+	item, ok := c.GetItem(key.String())
+	if !ok {
+		return
+	}
+	ok, err = assign(dst.Elem(), item)
+	if tme, isTypeMismatch := err.(*TypeMismatchError); isTypeMismatch {
+		tme.Key = key
+	}
+	if ok {
+		atomic.AddInt64(&s.timings.saved, int64(item.Saved))
+		if s.controller != nil {
+			s.controller.RecordSaved(key.Source, item.Saved)
+		}
+	}
+	return
+}
+
+// Add a value to the cache.
+func (s *Session) Add(key data.ID, v interface{}) (ok bool) {
+	return s.AddWithDuration(key, v, time.Duration(0))
+}
+
+// AddWithDuration adds a value to the cache, while recording how much time it would save
+// each time it's retrieved from the cache. If the session has a TTLPolicy, the value may not be added
+// if its source is invalidated too frequently for caching to be worthwhile.
+func (s *Session) AddWithDuration(key data.ID, v interface{}, d time.Duration) (ok bool) {
+	c, hasCache := s.Cache()
+	if !hasCache {
+		return
+	}
+	if s.ttlPolicy != nil {
+		s.ttlPolicy.RecordLoad(key.Source, d)
+		expiry, cacheable := s.ttlPolicy.Expiry(key.Source)
+		if !cacheable {
+			return
+		}
+		c.PutWithExpiry(key.String(), v, expiry, d)
+		ok = true
+		return
+	}
+	c.PutWithDuration(key.String(), v, d)
+	ok = true
+	return
+}
+
+// Invalidate removes data from the local cache, and queues it to be invalidated in other instances. The queued
+// invalidations are sent to the stream in a single write when the session ends, or when Flush is called.
+func (s *Session) Invalidate(keys ...data.ID) (ok bool) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, k := range keys {
+		// Remove the data immediately, so that it isn't read from the cache later in this session, or by
+		// concurrent sessions.
+		if s.cache != nil {
+			s.cache.Remove(k.String())
+		}
+		if contains(s.pending, k) {
+			continue
+		}
+		s.pending = append(s.pending, k)
+		// The engine's Observer skips its own invalidations, so they're counted here.
+		if s.ttlPolicy != nil {
+			s.ttlPolicy.RecordInvalidation(k.Source)
+		}
+	}
+	ok = true
+	return
+}
+
+// InvalidateObservables queues data to be invalidated, see Invalidate.
+func (s *Session) InvalidateObservables(changesTo ...changes.Observable) (ok bool) {
+	keys := make([]data.ID, len(changesTo))
+	for i, changed := range changesTo {
+		keys[i] = changed.ObservableID()
+	}
+	return s.Invalidate(keys...)
+}
+
+// Flush sends the queued invalidations to the stream. If the invalidations can't be sent, the data is
+// removed from the local cache, and the session's FlushErrorHandler is called. Since the data has already
+// changed, the invalidations are sent even if the context passed to Begin has been cancelled, e.g. because
+// the client disconnected, but they're only sent until its deadline, e.g. the deadline of a Lambda function.
+func (s *Session) Flush() (err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	keys := s.pending
+	s.pending = nil
+	s.mutex.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+	ctx := context.Background()
+	if s.hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, s.deadline)
+		defer cancel()
+	}
+	st := time.Now()
+	err = s.notifier.NotifyDataChanged(ctx, keys...)
+	atomic.AddInt64(&s.timings.flush, int64(time.Now().Sub(st)))
+	if err != nil {
+		logger.WithError(err).WithField("count", len(keys)).Error("error notifying on data changed")
+		for _, k := range keys {
+			s.cache.Remove(k.String())
+		}
+		if s.onFlushError != nil {
+			s.onFlushError(keys, err)
+		}
+	}
+	return
+}
+
+func contains(ids []data.ID, id data.ID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,294 @@
+package scache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/a-h/scache/adaptive"
+	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/changes"
+	"github.com/a-h/scache/data"
+	"github.com/a-h/scache/expiry"
+)
+
+func TestSessionsCanBeUsedWithoutHTTP(t *testing.T) {
+	// Arrange.
+	id1 := data.NewID("db.table.id", "1")
+	id2 := data.NewID("db.table.id", "2")
+	getter := testStreamGetter{
+		GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+			keys = []string{id1.String()}
+			return
+		},
+	}
+	engine := &Engine{
+		Observer: changes.NewObserver(getter),
+		Cache:    cache.New(),
+	}
+	engine.Cache.Put(id1.String(), "value 1")
+	engine.Cache.Put(id2.String(), "value 2")
+
+	// Act.
+	ctx, s := engine.Begin(context.Background())
+	defer s.End()
+
+	// Assert.
+	fromContext, ok := FromContext(ctx)
+	if !ok {
+		t.Fatal("expected the session to be in the context")
+	}
+	if fromContext != s {
+		t.Error("expected the session in the context to be the session returned by Begin")
+	}
+	var v string
+	if s.Get(id1, &v) {
+		t.Error("expected invalidated data to have been removed")
+	}
+	if !s.Get(id2, &v) {
+		t.Fatal("expected to be able to get data which wasn't invalidated")
+	}
+	if v != "value 2" {
+		t.Errorf("expected 'value 2', got '%v'", v)
+	}
+}
+
+func TestSessionsAreOptional(t *testing.T) {
+	s, ok := FromContext(context.Background())
+	if ok {
+		t.Fatal("didn't expect a session to be present")
+	}
+	var v string
+	if s.Get(data.NewID("db.table.id", "1"), &v) {
+		t.Error("expected a nil session to miss")
+	}
+	if s.Add(data.NewID("db.table.id", "1"), "value") {
+		t.Error("expected a nil session not to add to the cache")
+	}
+	s.End()
+}
+
+type testStreamPutter struct {
+	PutFunc func(keys []string) error
+}
+
+func (tsp testStreamPutter) Put(ctx context.Context, keys []string) error {
+	return tsp.PutFunc(keys)
+}
+
+func TestInvalidationsAreSentInASingleWrite(t *testing.T) {
+	// Arrange.
+	id1 := data.NewID("db.table.id", "1")
+	id2 := data.NewID("db.table.id", "2")
+	id3 := data.NewID("db.table.id", "3")
+	var puts [][]string
+	putter := testStreamPutter{
+		PutFunc: func(keys []string) error {
+			puts = append(puts, keys)
+			return nil
+		},
+	}
+	engine := &Engine{
+		Observer: changes.NewObserver(testStreamGetter{GetFunc: emptyGet}),
+		Cache:    cache.New(),
+		Notifier: changes.NewNotifier(putter),
+	}
+	ctx, s := engine.Begin(context.Background())
+
+	// Act.
+	s.Invalidate(id1, id2)
+	s, _ = FromContext(ctx)
+	s.Invalidate(id1)
+	s.InvalidateObservables(testObservable{id: id3})
+	if len(puts) != 0 {
+		t.Fatalf("expected invalidations to be queued until the session ends, but %d writes were made", len(puts))
+	}
+	s.End()
+
+	// Assert.
+	expected := [][]string{{id1.String(), id2.String(), id3.String()}}
+	if !reflect.DeepEqual(puts, expected) {
+		t.Errorf("expected puts %v, got %v", expected, puts)
+	}
+}
+
+func TestFlushErrorsAreReported(t *testing.T) {
+	// Arrange.
+	id1 := data.NewID("db.table.id", "1")
+	putter := testStreamPutter{
+		PutFunc: func(keys []string) error {
+			return errors.New("network error")
+		},
+	}
+	var reportedIDs []data.ID
+	var reportedErr error
+	engine := &Engine{
+		Observer: changes.NewObserver(testStreamGetter{GetFunc: emptyGet}),
+		Cache:    cache.New(),
+		Notifier: changes.NewNotifier(putter),
+		OnFlushError: func(ids []data.ID, err error) {
+			reportedIDs = ids
+			reportedErr = err
+		},
+	}
+	_, s := engine.Begin(context.Background())
+	s.Add(id1, "value")
+
+	// Act.
+	s.Invalidate(id1)
+	err := s.Flush()
+
+	// Assert.
+	if err == nil {
+		t.Error("expected the error to be returned from Flush")
+	}
+	if reportedErr == nil || !reflect.DeepEqual(reportedIDs, []data.ID{id1}) {
+		t.Errorf("expected the error handler to receive the failed IDs, got %v, %v", reportedIDs, reportedErr)
+	}
+	var v string
+	if s.Get(id1, &v) {
+		t.Error("expected the data to be removed from the local cache")
+	}
+	if err = s.Flush(); err != nil {
+		t.Errorf("expected nothing to be pending after flushing, but got %v", err)
+	}
+}
+
+func emptyGet(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+	return
+}
+
+type testObservable struct {
+	id data.ID
+}
+
+func (to testObservable) ObservableID() data.ID {
+	return to.id
+}
+
+func TestTTLPolicyIsAppliedToAddedItems(t *testing.T) {
+	// Arrange.
+	c := cache.New()
+	c.Put(data.NewID("db.other.id", "1").String(), "value")
+	policy := adaptive.NewTTLPolicy(time.Minute, time.Hour)
+	engine := &Engine{
+		Observer: changes.NewObserver(testStreamGetter{
+			GetFunc: func(from expiry.StreamPosition) (keys []string, to expiry.StreamPosition, err error) {
+				for i := 0; i < 100; i++ {
+					keys = append(keys, data.NewID("db.volatile.id", strconv.Itoa(i)).String())
+				}
+				return
+			},
+		}),
+		Cache:     c,
+		TTLPolicy: policy,
+	}
+
+	// Act.
+	_, s := engine.Begin(context.Background())
+	volatileAdded := s.AddWithDuration(data.NewID("db.volatile.id", "1"), "value", time.Millisecond)
+	stableAdded := s.AddWithDuration(data.NewID("db.stable.id", "1"), "value", time.Millisecond)
+	s.End()
+
+	// Assert.
+	if volatileAdded {
+		t.Errorf("expected frequently invalidated data not to be cached")
+	}
+	if !stableAdded {
+		t.Fatalf("expected data which hasn't been invalidated to be cached")
+	}
+	item, ok := c.GetItem(data.NewID("db.stable.id", "1").String())
+	if !ok {
+		t.Fatalf("expected the stable item to be in the cache")
+	}
+	if until := item.Expiry.Sub(time.Now()); until > time.Hour || until < time.Minute*44 {
+		t.Errorf("expected the stable item to expire in up to an hour, got %v", until)
+	}
+	if s := policy.Sources()["db.volatile.id"]; s.Cached || s.InvalidationsPerHour == 0 {
+		t.Errorf("expected the volatile source's stats to be available, got %+v", s)
+	}
+}
+
+func TestInvalidatedDataIsRemovedFromTheLocalCacheImmediately(t *testing.T) {
+	id := data.NewID("db.table.id", "1")
+	engine := &Engine{
+		Observer: changes.NewObserver(testStreamGetter{GetFunc: emptyGet}),
+		Cache:    cache.New(),
+		Notifier: changes.NewNotifier(testStreamPutter{
+			PutFunc: func(keys []string) error {
+				return nil
+			},
+		}),
+	}
+	engine.Cache.Put(id.String(), "value")
+	_, s := engine.Begin(context.Background())
+	defer s.End()
+
+	s.Invalidate(id)
+
+	var v string
+	if s.Get(id, &v) {
+		t.Errorf("expected the invalidated data to be removed before the invalidation is sent, but got %q", v)
+	}
+}
+
+type contextStreamPutter func(ctx context.Context, keys []string) error
+
+func (f contextStreamPutter) Put(ctx context.Context, keys []string) error {
+	return f(ctx, keys)
+}
+
+func TestInvalidationsAreSentWhenTheContextIsCancelled(t *testing.T) {
+	// Arrange.
+	deadline := time.Now().Add(time.Minute)
+	var putErr error
+	var putDeadline time.Time
+	engine := &Engine{
+		Observer: changes.NewObserver(testStreamGetter{GetFunc: emptyGet}),
+		Cache:    cache.New(),
+		Notifier: changes.NewNotifier(contextStreamPutter(func(ctx context.Context, keys []string) error {
+			putErr = ctx.Err()
+			putDeadline, _ = ctx.Deadline()
+			return nil
+		})),
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	_, s := engine.Begin(ctx)
+	s.Invalidate(data.NewID("db.table.id", "1"))
+
+	// Act: the client disconnects.
+	cancel()
+	s.End()
+
+	// Assert.
+	if putErr != nil {
+		t.Errorf("expected the invalidations to be sent, but the context was done: %v", putErr)
+	}
+	if !putDeadline.Equal(deadline) {
+		t.Errorf("expected the invalidations to be sent before the deadline %v, got %v", deadline, putDeadline)
+	}
+}
+
+func TestInvalidationsAreRecordedByTheTTLPolicy(t *testing.T) {
+	// Arrange.
+	policy := adaptive.NewTTLPolicy(time.Minute, time.Hour)
+	engine := &Engine{
+		Observer:  changes.NewObserver(testStreamGetter{GetFunc: emptyGet}),
+		Cache:     cache.New(),
+		Notifier:  changes.NewNotifier(testStreamPutter{PutFunc: func(keys []string) error { return nil }}),
+		TTLPolicy: policy,
+	}
+
+	// Act.
+	_, s := engine.Begin(context.Background())
+	s.Invalidate(data.NewID("db.table.id", "1"), data.NewID("db.table.id", "1"))
+	s.End()
+
+	// Assert.
+	if st := policy.Sources()["db.table.id"]; st.InvalidationsPerHour == 0 {
+		t.Errorf("expected the engine's own invalidations to be recorded, got %+v", st)
+	}
+}
@@ -0,0 +1,117 @@
+package scache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Timings shows where time was spent during a session, and how much time the cache saved.
+type Timings struct {
+	// Expire is the time spent removing expired items from the cache.
+	Expire time.Duration
+	// Observe is the time spent reading the stream.
+	Observe time.Duration
+	// Handler is the time spent in the handler.
+	Handler time.Duration
+	// Flush is the time spent sending invalidations to the stream.
+	Flush time.Duration
+	// Saved is the time saved by retrieving items from the cache.
+	Saved time.Duration
+	// Hits is the number of items retrieved from the cache.
+	Hits int64
+	// Misses is the number of items which were not in the cache.
+	Misses int64
+	// BacklogSkipped is true if the backlog of the stream was too large to read, so the cache was flushed
+	// instead.
+	BacklogSkipped bool
+}
+
+// ServerTiming formats the timings as the value of a Server-Timing HTTP header, see
+// https://www.w3.org/TR/server-timing/
+func (t Timings) ServerTiming() string {
+	metrics := []string{
+		durationMetric("expire", t.Expire),
+		durationMetric("observe", t.Observe),
+		durationMetric("handler", t.Handler),
+		durationMetric("flush", t.Flush),
+		durationMetric("saved", t.Saved),
+		fmt.Sprintf(`hits;desc="%d"`, t.Hits),
+		fmt.Sprintf(`misses;desc="%d"`, t.Misses),
+	}
+	if t.BacklogSkipped {
+		metrics = append(metrics, `backlog;desc="skipped"`)
+	}
+	return strings.Join(metrics, ", ")
+}
+
+func durationMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
+
+// timings is updated concurrently by handlers which fan out work to multiple goroutines.
+type timings struct {
+	expire  int64
+	observe int64
+	handler int64
+	flush   int64
+	saved   int64
+	hits    int64
+	misses  int64
+	// backlogSkipped is 1 if the backlog was skipped.
+	backlogSkipped int64
+}
+
+func (t *timings) get() Timings {
+	return Timings{
+		Expire:         time.Duration(atomic.LoadInt64(&t.expire)),
+		Observe:        time.Duration(atomic.LoadInt64(&t.observe)),
+		Handler:        time.Duration(atomic.LoadInt64(&t.handler)),
+		Flush:          time.Duration(atomic.LoadInt64(&t.flush)),
+		Saved:          time.Duration(atomic.LoadInt64(&t.saved)),
+		Hits:           atomic.LoadInt64(&t.hits),
+		Misses:         atomic.LoadInt64(&t.misses),
+		BacklogSkipped: atomic.LoadInt64(&t.backlogSkipped) == 1,
+	}
+}
+
+// serverTimingWriter adds the Server-Timing header to the response before the headers are written.
+type serverTimingWriter struct {
+	http.ResponseWriter
+	s           *Session
+	wroteHeader bool
+}
+
+func (w *serverTimingWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		t := w.s.Timings()
+		// The handler hasn't finished yet, so record the time spent in it so far.
+		t.Handler = time.Now().Sub(w.s.handlerStart)
+		w.Header().Add("Server-Timing", t.ServerTiming())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *serverTimingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to access the underlying ResponseWriter.
+func (w *serverTimingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,125 @@
+package scache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/changes"
+	"github.com/a-h/scache/data"
+)
+
+func TestTimingsAreSafeForConcurrentUse(t *testing.T) {
+	// Arrange.
+	hit := data.NewID("db.table.id", "hit")
+	miss := data.NewID("db.table.id", "miss")
+	c := cache.New()
+	c.PutWithDuration(hit.String(), "value", time.Millisecond)
+	s := &Session{cache: c}
+
+	// Act.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var v string
+			s.Get(hit, &v)
+			s.Get(miss, &v)
+		}()
+	}
+	wg.Wait()
+
+	// Assert.
+	timings := s.Timings()
+	if timings.Hits != 100 {
+		t.Errorf("expected 100 hits, got %d", timings.Hits)
+	}
+	if timings.Misses != 100 {
+		t.Errorf("expected 100 misses, got %d", timings.Misses)
+	}
+	if timings.Saved != time.Millisecond*100 {
+		t.Errorf("expected 100ms to be saved, got %v", timings.Saved)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverTiming bool
+		handler      http.HandlerFunc
+	}{
+		{
+			name:         "header is added when the handler writes",
+			serverTiming: true,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				var v string
+				Get(r, data.NewID("db.table.id", "1"), &v)
+				w.Write([]byte("OK"))
+			},
+		},
+		{
+			name:         "header is added when the handler doesn't write",
+			serverTiming: true,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				var v string
+				Get(r, data.NewID("db.table.id", "1"), &v)
+			},
+		},
+		{
+			name:         "header is not added by default",
+			serverTiming: false,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("OK"))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		mw := (&Engine{
+			Observer:     changes.NewObserver(testStreamGetter{GetFunc: emptyGet}),
+			Cache:        cache.New(),
+			ServerTiming: test.serverTiming,
+		}).Middleware(test.handler)
+		w := httptest.NewRecorder()
+		mw.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		header := w.Header().Get("Server-Timing")
+		if !test.serverTiming {
+			if header != "" {
+				t.Errorf("%s: expected no header, got '%v'", test.name, header)
+			}
+			continue
+		}
+		for _, expected := range []string{"expire;dur=", "observe;dur=", "handler;dur=", "saved;dur=", `hits;desc="0"`, `misses;desc="1"`} {
+			if !strings.Contains(header, expected) {
+				t.Errorf("%s: expected header to contain '%v', got '%v'", test.name, expected, header)
+			}
+		}
+	}
+}
+
+func TestServerTimingFormat(t *testing.T) {
+	timings := Timings{
+		Expire:  time.Microsecond * 100,
+		Observe: time.Millisecond * 20,
+		Handler: time.Millisecond * 30,
+		Saved:   time.Second,
+		Hits:    2,
+		Misses:  1,
+	}
+	expected := `expire;dur=0.100, observe;dur=20.000, handler;dur=30.000, flush;dur=0.000, saved;dur=1000.000, hits;desc="2", misses;desc="1"`
+	if actual := timings.ServerTiming(); actual != expected {
+		t.Errorf("expected '%v', got '%v'", expected, actual)
+	}
+}
+
+func TestServerTimingShowsSkippedBacklogs(t *testing.T) {
+	timings := Timings{BacklogSkipped: true}
+	if actual := timings.ServerTiming(); !strings.HasSuffix(actual, `, backlog;desc="skipped"`) {
+		t.Errorf("expected the skipped backlog to be shown, got '%v'", actual)
+	}
+}
@@ -0,0 +1,100 @@
+package scache
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/data"
+)
+
+// ErrInvalidDestination is returned by TryGet when the value to populate is not a non-nil pointer.
+var ErrInvalidDestination = errors.New("scache: the destination must be a non-nil pointer")
+
+// TypeMismatchError is returned by TryGet when the value in the cache can't be assigned to the destination.
+type TypeMismatchError struct {
+	Key       data.ID
+	Stored    reflect.Type
+	Requested reflect.Type
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("scache: cannot assign cached value of type %v to %v for key '%v'", e.Stored, e.Requested, e.Key)
+}
+
+// assign sets dst to the value of the cache item. Pointers are dereferenced, or taken as required, and
+// numeric values are converted. If the item's value is nil, or it's a struct whose fingerprint doesn't match
+// the struct requested, e.g. because the struct's fields have changed, the item is treated as a miss.
+func assign(dst reflect.Value, item cache.Item) (ok bool, err error) {
+	if item.Value == nil {
+		return
+	}
+	src := reflect.ValueOf(item.Value)
+	if src.Kind() == reflect.Ptr {
+		if src.IsNil() {
+			return
+		}
+		if !src.Type().AssignableTo(dst.Type()) {
+			// Stored as a pointer, requested as a value.
+			src = src.Elem()
+		}
+	}
+	dt := dst.Type()
+	switch {
+	case src.Type().AssignableTo(dt):
+		dst.Set(src)
+	case dt.Kind() == reflect.Ptr && src.Type().AssignableTo(dt.Elem()):
+		// Stored as a value, requested as a pointer. Use a copy, so that the cached value can't be modified.
+		p := reflect.New(dt.Elem())
+		p.Elem().Set(src)
+		dst.Set(p)
+	case convertible(src.Type(), dt):
+		dst.Set(src.Convert(dt))
+	case schemaChanged(item, src.Type(), dt):
+		return
+	default:
+		err = &TypeMismatchError{
+			Stored:    reflect.TypeOf(item.Value),
+			Requested: dt,
+		}
+		return
+	}
+	ok = true
+	return
+}
+
+// schemaChanged returns true if a struct was requested, but the item holds a struct with a different
+// fingerprint. Values which can be assigned or converted are handled before the fingerprints are compared,
+// so they're only calculated when the types don't match.
+func schemaChanged(item cache.Item, src, dst reflect.Type) bool {
+	if dst.Kind() == reflect.Ptr {
+		dst = dst.Elem()
+	}
+	if src.Kind() != reflect.Struct || dst.Kind() != reflect.Struct || item.Fingerprint == "" {
+		return false
+	}
+	return item.Fingerprint != cache.Fingerprint(dst)
+}
+
+// convertible types are those that Go can convert between without changing their meaning, e.g. int to int64,
+// or between structs with the same fields. Conversions such as int to string are not allowed.
+func convertible(from, to reflect.Type) bool {
+	if !from.ConvertibleTo(to) {
+		return false
+	}
+	return from.Kind() == to.Kind() || (isInt(from) && isInt(to)) || (isFloat(from) && isFloat(to))
+}
+
+func isInt(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func isFloat(t reflect.Type) bool {
+	return t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64
+}
@@ -0,0 +1,138 @@
+package scache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/a-h/scache/cache"
+	"github.com/a-h/scache/data"
+)
+
+func TestTryGet(t *testing.T) {
+	type user struct {
+		Name string
+	}
+	type otherUser struct {
+		Name string
+	}
+	type renamedUser struct {
+		FullName string
+	}
+	tests := []struct {
+		name          string
+		item          cache.Item
+		dst           interface{}
+		expectedOK    bool
+		expectedValue interface{}
+		expectedErr   bool
+	}{
+		{
+			name:          "same type",
+			item:          cache.NewCacheItem(user{Name: "A"}, time.Now(), 0),
+			dst:           &user{},
+			expectedOK:    true,
+			expectedValue: user{Name: "A"},
+		},
+		{
+			name:          "stored as a pointer, requested as a value",
+			item:          cache.NewCacheItem(&user{Name: "A"}, time.Now(), 0),
+			dst:           &user{},
+			expectedOK:    true,
+			expectedValue: user{Name: "A"},
+		},
+		{
+			name:          "stored as a value, requested as a pointer",
+			item:          cache.NewCacheItem(user{Name: "A"}, time.Now(), 0),
+			dst:           new(*user),
+			expectedOK:    true,
+			expectedValue: &user{Name: "A"},
+		},
+		{
+			name:          "convertible numbers",
+			item:          cache.NewCacheItem(int32(42), time.Now(), 0),
+			dst:           new(int64),
+			expectedOK:    true,
+			expectedValue: int64(42),
+		},
+		{
+			name:          "convertible structs",
+			item:          cache.NewCacheItem(user{Name: "A"}, time.Now(), 0),
+			dst:           &otherUser{},
+			expectedOK:    true,
+			expectedValue: otherUser{Name: "A"},
+		},
+		{
+			name:        "numbers aren't converted to strings",
+			item:        cache.NewCacheItem(65, time.Now(), 0),
+			dst:         new(string),
+			expectedErr: true,
+		},
+		{
+			name:        "different types",
+			item:        cache.NewCacheItem(user{Name: "A"}, time.Now(), 0),
+			dst:         new(int),
+			expectedErr: true,
+		},
+		{
+			name: "nil values are a miss",
+			item: cache.NewCacheItem(nil, time.Now(), 0),
+			dst:  &user{},
+		},
+		{
+			name: "nil pointers are a miss",
+			item: cache.NewCacheItem((*user)(nil), time.Now(), 0),
+			dst:  &user{},
+		},
+		{
+			name: "changed schemas are a miss",
+			item: cache.NewCacheItem(user{Name: "A"}, time.Now(), 0),
+			dst:  &renamedUser{},
+		},
+		{
+			name: "changed schemas requested as a pointer are a miss",
+			item: cache.NewCacheItem(&user{Name: "A"}, time.Now(), 0),
+			dst:  new(*renamedUser),
+		},
+		{
+			name:        "destination isn't a pointer",
+			item:        cache.NewCacheItem(user{Name: "A"}, time.Now(), 0),
+			dst:         user{},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		key := data.NewID("db.table.id", "1")
+		c := cache.New()
+		c.PutCacheItem(key.String(), test.item)
+		s := &Session{cache: c}
+
+		var ok, getOK bool
+		var err error
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: unexpected panic: %v", test.name, r)
+				}
+			}()
+			ok, err = s.TryGet(key, test.dst)
+			getOK = s.Get(key, test.dst)
+		}()
+		if ok != test.expectedOK {
+			t.Errorf("%s: expected ok to be %v, got %v", test.name, test.expectedOK, ok)
+		}
+		if getOK != test.expectedOK {
+			t.Errorf("%s: expected Get to return %v, got %v", test.name, test.expectedOK, getOK)
+		}
+		if (err != nil) != test.expectedErr {
+			t.Errorf("%s: expected error: %v, got %v", test.name, test.expectedErr, err)
+		}
+		if test.expectedOK {
+			actual := reflect.ValueOf(test.dst).Elem().Interface()
+			if !reflect.DeepEqual(actual, test.expectedValue) {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expectedValue, actual)
+			}
+		}
+	}
+}